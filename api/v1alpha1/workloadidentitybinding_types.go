@@ -0,0 +1,101 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkloadIdentityBindingSpec defines the workload identity of a
+// ServiceAccount.
+type WorkloadIdentityBindingSpec struct {
+	// ServiceAccountName is the name of the Kubernetes ServiceAccount, in the
+	// namespace of the binding, the identity is bound to.
+	// +kubebuilder:validation:MinLength=1
+	ServiceAccountName string `json:"serviceAccountName"`
+
+	// GCPServiceAccount is the email of the GCP service account impersonated
+	// by the ServiceAccount. It is required unless impersonation is
+	// disabled.
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+$`
+	// +optional
+	GCPServiceAccount string `json:"gcpServiceAccount,omitempty"`
+
+	// Impersonation can be set to false to use the federated token directly
+	// instead of impersonating the GCP service account. Defaults to true.
+	// +optional
+	Impersonation *bool `json:"impersonation,omitempty"`
+
+	// TokenLifetime is the lifetime of the impersonated access tokens. Must
+	// be between 10 minutes and 12 hours.
+	// +optional
+	TokenLifetime *metav1.Duration `json:"tokenLifetime,omitempty"`
+
+	// QuotaProject is the project used for quota and billing of the API
+	// calls.
+	// +optional
+	QuotaProject string `json:"quotaProject,omitempty"`
+}
+
+// WorkloadIdentityBindingStatus defines the observed state of a
+// WorkloadIdentityBinding.
+type WorkloadIdentityBindingStatus struct {
+	// ObservedGeneration is the generation of the binding the status was
+	// computed from.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// SecretName is the name of the credentials Secret of the
+	// ServiceAccount.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+
+	// Conditions are the conditions of the workload identity setup.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=wib
+//+kubebuilder:printcolumn:name="Service Account",type=string,JSONPath=`.spec.serviceAccountName`
+//+kubebuilder:printcolumn:name="GCP Service Account",type=string,JSONPath=`.spec.gcpServiceAccount`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// WorkloadIdentityBinding binds a GCP identity to a Kubernetes
+// ServiceAccount without annotating the ServiceAccount.
+type WorkloadIdentityBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WorkloadIdentityBindingSpec   `json:"spec,omitempty"`
+	Status WorkloadIdentityBindingStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// WorkloadIdentityBindingList contains a list of WorkloadIdentityBinding.
+type WorkloadIdentityBindingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WorkloadIdentityBinding `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&WorkloadIdentityBinding{}, &WorkloadIdentityBindingList{})
+}
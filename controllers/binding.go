@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/api/v1alpha1"
+)
+
+const (
+	ReasonOverriddenByAnnotations = "OverriddenByAnnotations"
+	ReasonBindingConflict         = "BindingConflict"
+	ReasonServiceAccountNotFound  = "ServiceAccountNotFound"
+
+	// BindingServiceAccountNameField indexes the WorkloadIdentityBindings by
+	// the name of the ServiceAccount they bind.
+	BindingServiceAccountNameField = "spec.serviceAccountName"
+)
+
+// listBindings returns the WorkloadIdentityBindings of the ServiceAccount
+// with the given key, oldest first. There are none when the bindings are
+// disabled.
+func (r *ServiceAccountReconciler) listBindings(ctx context.Context, key k8stypes.NamespacedName) ([]v1alpha1.WorkloadIdentityBinding, error) {
+	if r.DisableBindings {
+		return nil, nil
+	}
+
+	bindings, err := ListServiceAccountBindings(ctx, r.Client, key)
+	if err != nil {
+		r.Logger.Error(err, "failed to list workload identity bindings", "namespace", key.Namespace)
+		return nil, err
+	}
+
+	return bindings, nil
+}
+
+// ListServiceAccountBindings returns the WorkloadIdentityBindings of the
+// ServiceAccount with the given key that are not being deleted, oldest
+// first. The first one is the binding the ServiceAccount is configured from,
+// unless it is annotated.
+func ListServiceAccountBindings(ctx context.Context, reader client.Reader, key k8stypes.NamespacedName) ([]v1alpha1.WorkloadIdentityBinding, error) {
+	bindingList := &v1alpha1.WorkloadIdentityBindingList{}
+
+	err := reader.List(ctx, bindingList, client.InNamespace(key.Namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := []v1alpha1.WorkloadIdentityBinding{}
+	for _, binding := range bindingList.Items {
+		if binding.Spec.ServiceAccountName == key.Name && binding.DeletionTimestamp.IsZero() {
+			bindings = append(bindings, binding)
+		}
+	}
+
+	sort.SliceStable(bindings, func(i, j int) bool {
+		if !bindings[i].CreationTimestamp.Equal(&bindings[j].CreationTimestamp) {
+			return bindings[i].CreationTimestamp.Before(&bindings[j].CreationTimestamp)
+		}
+		return bindings[i].Name < bindings[j].Name
+	})
+
+	return bindings, nil
+}
+
+// effectiveAnnotations returns the annotations the workload identity of the
+// ServiceAccount is configured from, and the binding they come from, if
+// any. The annotations of the ServiceAccount take precedence over bindings,
+// and the oldest binding takes precedence over the others.
+func effectiveAnnotations(serviceAccount *corev1.ServiceAccount, bindings []v1alpha1.WorkloadIdentityBinding) (map[string]string, *v1alpha1.WorkloadIdentityBinding) {
+	if IsWorkloadIdentityEnabled(serviceAccount.Annotations) || len(bindings) == 0 {
+		return serviceAccount.Annotations, nil
+	}
+
+	binding := &bindings[0]
+
+	annotations := map[string]string{}
+	for key, value := range serviceAccount.Annotations {
+		annotations[key] = value
+	}
+	for _, key := range identityAnnotations {
+		delete(annotations, key)
+	}
+	for key, value := range bindingAnnotations(binding) {
+		annotations[key] = value
+	}
+
+	return annotations, binding
+}
+
+// bindingAnnotations returns the ServiceAccount annotations equivalent to the
+// spec of the binding.
+func bindingAnnotations(binding *v1alpha1.WorkloadIdentityBinding) map[string]string {
+	annotations := map[string]string{}
+
+	impersonation := binding.Spec.Impersonation == nil || *binding.Spec.Impersonation
+	annotations[AnnotationGCPImpersonation] = strconv.FormatBool(impersonation)
+
+	// An empty GCP service account is reported as an invalid configuration
+	// when impersonating.
+	if impersonation || binding.Spec.GCPServiceAccount != "" {
+		annotations[AnnotationGCPServiceAccount] = binding.Spec.GCPServiceAccount
+	}
+
+	if binding.Spec.TokenLifetime != nil {
+		annotations[AnnotationGCPTokenLifetime] = binding.Spec.TokenLifetime.Duration.String()
+	}
+
+	if binding.Spec.QuotaProject != "" {
+		annotations[AnnotationGCPQuotaProject] = binding.Spec.QuotaProject
+	}
+
+	return annotations
+}
+
+// updateBindingStatuses reports the status of the ServiceAccount on the
+// active binding, and the reason they are ignored on the others.
+func (r *ServiceAccountReconciler) updateBindingStatuses(ctx context.Context, serviceAccount *corev1.ServiceAccount, bindings []v1alpha1.WorkloadIdentityBinding, active *v1alpha1.WorkloadIdentityBinding) error {
+	for i := range bindings {
+		binding := &bindings[i]
+		status := binding.Status.DeepCopy()
+		status.ObservedGeneration = binding.Generation
+
+		switch {
+		case serviceAccount == nil:
+			setBindingNotReady(status, binding, ReasonServiceAccountNotFound,
+				fmt.Sprintf("ServiceAccount %q does not exist", binding.Spec.ServiceAccountName))
+		case active == nil:
+			setBindingNotReady(status, binding, ReasonOverriddenByAnnotations,
+				fmt.Sprintf("ServiceAccount %q is configured with annotations", serviceAccount.Name))
+		case active.UID != binding.UID:
+			setBindingNotReady(status, binding, ReasonBindingConflict,
+				fmt.Sprintf("ServiceAccount %q is already bound by %q", serviceAccount.Name, active.Name))
+		default:
+			err := setBindingActive(status, binding, serviceAccount)
+			if err != nil {
+				return err
+			}
+		}
+
+		if equality.Semantic.DeepEqual(&binding.Status, status) {
+			continue
+		}
+
+		binding.Status = *status
+		err := r.Status().Update(ctx, binding)
+		if err != nil {
+			r.Logger.Error(err, "failed to update workload identity binding status", "binding", client.ObjectKeyFromObject(binding))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setBindingActive copies the status of the ServiceAccount to the status of
+// the binding it is configured from.
+func setBindingActive(status *v1alpha1.WorkloadIdentityBindingStatus, binding *v1alpha1.WorkloadIdentityBinding, serviceAccount *corev1.ServiceAccount) error {
+	serviceAccountStatus, err := GetWorkloadIdentityStatus(serviceAccount)
+	if err != nil {
+		return err
+	}
+
+	status.SecretName = CredentialsSecretName(serviceAccount)
+	for _, condition := range serviceAccountStatus.Conditions {
+		condition.ObservedGeneration = binding.Generation
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+
+	return nil
+}
+
+// setBindingNotReady marks a binding that is not used to configure its
+// ServiceAccount as not ready.
+func setBindingNotReady(status *v1alpha1.WorkloadIdentityBindingStatus, binding *v1alpha1.WorkloadIdentityBinding, reason, message string) {
+	status.SecretName = ""
+	for _, conditionType := range readinessConditions {
+		meta.RemoveStatusCondition(&status.Conditions, conditionType)
+	}
+
+	condition := conditionFalse(ConditionReady, reason, message)
+	condition.ObservedGeneration = binding.Generation
+	meta.SetStatusCondition(&status.Conditions, condition)
+}
+
+// IndexBindings indexes the WorkloadIdentityBindings by
+// BindingServiceAccountNameField, so that the ServiceAccountPredicate can
+// look up the bindings of a ServiceAccount.
+func IndexBindings(ctx context.Context, indexer client.FieldIndexer) error {
+	return indexer.IndexField(ctx, &v1alpha1.WorkloadIdentityBinding{}, BindingServiceAccountNameField, func(object client.Object) []string {
+		binding, ok := object.(*v1alpha1.WorkloadIdentityBinding)
+		if !ok {
+			return nil
+		}
+
+		return []string{binding.Spec.ServiceAccountName}
+	})
+}
+
+// enqueueBindingServiceAccount maps a WorkloadIdentityBinding to the
+// ServiceAccount it binds.
+func enqueueBindingServiceAccount(object client.Object) []reconcile.Request {
+	binding, ok := object.(*v1alpha1.WorkloadIdentityBinding)
+	if !ok {
+		return nil
+	}
+
+	return []reconcile.Request{
+		{
+			NamespacedName: k8stypes.NamespacedName{
+				Namespace: binding.Namespace,
+				Name:      binding.Spec.ServiceAccountName,
+			},
+		},
+	}
+}
+
+// listManagedServiceAccounts returns the keys of the ServiceAccounts that are
+// configured with annotations or bound by a WorkloadIdentityBinding. The
+// bindings are not listed when they are disabled, as their CRD may not be
+// installed.
+func (r *ServiceAccountReconciler) listManagedServiceAccounts(ctx context.Context, opts ...client.ListOption) ([]k8stypes.NamespacedName, error) {
+	serviceAccounts := &corev1.ServiceAccountList{}
+	err := r.List(ctx, serviceAccounts, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := &v1alpha1.WorkloadIdentityBindingList{}
+	if !r.DisableBindings {
+		err = r.List(ctx, bindings, opts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[k8stypes.NamespacedName]bool{}
+	keys := []k8stypes.NamespacedName{}
+	add := func(key k8stypes.NamespacedName) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for i := range serviceAccounts.Items {
+		serviceAccount := &serviceAccounts.Items[i]
+		if IsWorkloadIdentityEnabled(serviceAccount.Annotations) {
+			add(client.ObjectKeyFromObject(serviceAccount))
+		}
+	}
+
+	for _, binding := range bindings.Items {
+		add(k8stypes.NamespacedName{
+			Namespace: binding.Namespace,
+			Name:      binding.Spec.ServiceAccountName,
+		})
+	}
+
+	return keys, nil
+}
+
+// BindingsInstalled reports whether the WorkloadIdentityBinding CRD is
+// installed in the cluster of the given RESTMapper.
+func BindingsInstalled(mapper meta.RESTMapper) (bool, error) {
+	_, err := mapper.RESTMapping(v1alpha1.GroupVersion.WithKind("WorkloadIdentityBinding").GroupKind(), v1alpha1.GroupVersion.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
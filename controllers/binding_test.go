@@ -0,0 +1,461 @@
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/api/v1alpha1"
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
+	"github.com/giantswarm/workload-identity-operator-gcp/tests"
+)
+
+var _ = Describe("Workload Identity Binding", func() {
+	var (
+		ctx context.Context
+
+		serviceAccountName string
+		secretName         string
+
+		serviceAccount *corev1.ServiceAccount
+		binding        *v1alpha1.WorkloadIdentityBinding
+
+		reconciler  *controllers.ServiceAccountReconciler
+		reconcilErr error
+	)
+
+	newBinding := func(name, gcpServiceAccount string) *v1alpha1.WorkloadIdentityBinding {
+		return &v1alpha1.WorkloadIdentityBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Spec: v1alpha1.WorkloadIdentityBindingSpec{
+				ServiceAccountName: serviceAccountName,
+				GCPServiceAccount:  gcpServiceAccount,
+			},
+		}
+	}
+
+	reconcileServiceAccount := func() {
+		_, reconcilErr = reconciler.Reconcile(ctx, reconcile.Request{
+			NamespacedName: client.ObjectKey{Namespace: namespace, Name: serviceAccountName},
+		})
+	}
+
+	getReadyCondition := func(binding *v1alpha1.WorkloadIdentityBinding) *metav1.Condition {
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(binding), binding)).To(Succeed())
+		return meta.FindStatusCondition(binding.Status.Conditions, controllers.ConditionReady)
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		serviceAccountName = "the-bound-service-account"
+		secretName = controllers.DefaultCredentialsSecretName(serviceAccountName)
+
+		serviceAccount = &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      serviceAccountName,
+				Namespace: namespace,
+			},
+		}
+		Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+
+		binding = newBinding("the-binding", "bound@project.iam.gserviceaccount.com")
+		Expect(k8sClient.Create(ctx, binding)).To(Succeed())
+
+		tests.EnsureMembershipSecretExists(k8sClient, "binding.svc.id.goog", "https://binding.default.local")
+
+		reconciler = &controllers.ServiceAccountReconciler{
+			Client:     k8sClient,
+			Logger:     ctrl.Log.WithName("service-account-reconciler"),
+			Scheme:     scheme,
+			Recorder:   record.NewFakeRecorder(100),
+			Membership: controllers.NewMembershipStore(k8sClient, nil, ctrl.Log.WithName("membership-store")),
+		}
+	})
+
+	JustBeforeEach(func() {
+		reconcileServiceAccount()
+	})
+
+	AfterEach(func() {
+		membershipSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			},
+		}
+		Expect(k8sClient.Delete(ctx, membershipSecret)).To(Succeed())
+	})
+
+	It("generates the credentials of the bound service account", func() {
+		Expect(reconcilErr).NotTo(HaveOccurred())
+
+		config := getCredentialConfig(ctx, secretName)
+		Expect(config.ServiceAccountImpersonationURL).To(ContainSubstring("bound@project.iam.gserviceaccount.com"))
+	})
+
+	It("reports the status on the binding", func() {
+		condition := getReadyCondition(binding)
+		Expect(condition).NotTo(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+		Expect(condition.ObservedGeneration).To(Equal(binding.Generation))
+		Expect(binding.Status.ObservedGeneration).To(Equal(binding.Generation))
+		Expect(binding.Status.SecretName).To(Equal(secretName))
+	})
+
+	When("the bindings are disabled", func() {
+		BeforeEach(func() {
+			reconciler.DisableBindings = true
+		})
+
+		It("ignores the binding", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			secret := &corev1.Secret{}
+			err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, secret)
+			Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+			Expect(getReadyCondition(binding)).To(BeNil())
+		})
+	})
+
+	It("detects that the binding CRD is installed", func() {
+		installed, err := controllers.BindingsInstalled(k8sClient.RESTMapper())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(installed).To(BeTrue())
+	})
+
+	When("the binding CRD is not installed", func() {
+		It("detects it", func() {
+			installed, err := controllers.BindingsInstalled(meta.NewDefaultRESTMapper(nil))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(installed).To(BeFalse())
+		})
+	})
+
+	When("the binding has options", func() {
+		BeforeEach(func() {
+			binding.Spec.TokenLifetime = &metav1.Duration{Duration: 2 * time.Hour}
+			binding.Spec.QuotaProject = "billing-project"
+			Expect(k8sClient.Update(ctx, binding)).To(Succeed())
+		})
+
+		It("renders the options in the credentials", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			config := getCredentialConfig(ctx, secretName)
+			Expect(config.ServiceAccountImpersonation).NotTo(BeNil())
+			Expect(config.ServiceAccountImpersonation.TokenLifetimeSeconds).To(Equal(int64(7200)))
+			Expect(config.QuotaProjectID).To(Equal("billing-project"))
+		})
+	})
+
+	When("the service account is also annotated", func() {
+		BeforeEach(func() {
+			serviceAccount.Annotations = map[string]string{
+				controllers.AnnotationGCPServiceAccount: "annotated@project.iam.gserviceaccount.com",
+			}
+			Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+		})
+
+		It("uses the annotations", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			config := getCredentialConfig(ctx, secretName)
+			Expect(config.ServiceAccountImpersonationURL).To(ContainSubstring("annotated@project.iam.gserviceaccount.com"))
+		})
+
+		It("reports the binding as overridden", func() {
+			condition := getReadyCondition(binding)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(controllers.ReasonOverriddenByAnnotations))
+		})
+	})
+
+	When("the service account is bound by several bindings", func() {
+		var newerBinding *v1alpha1.WorkloadIdentityBinding
+
+		BeforeEach(func() {
+			newerBinding = newBinding("the-newer-binding", "newer@project.iam.gserviceaccount.com")
+			Expect(k8sClient.Create(ctx, newerBinding)).To(Succeed())
+		})
+
+		It("uses the oldest binding", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			config := getCredentialConfig(ctx, secretName)
+			Expect(config.ServiceAccountImpersonationURL).To(ContainSubstring("bound@project.iam.gserviceaccount.com"))
+		})
+
+		It("reports the conflict on the newer binding", func() {
+			condition := getReadyCondition(newerBinding)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(controllers.ReasonBindingConflict))
+		})
+	})
+
+	When("the binding is deleted", func() {
+		JustBeforeEach(func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+			Expect(k8sClient.Delete(ctx, binding)).To(Succeed())
+
+			reconcileServiceAccount()
+		})
+
+		It("deletes the secret", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, &corev1.Secret{})
+			Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	When("the service account does not exist", func() {
+		BeforeEach(func() {
+			Expect(k8sClient.Delete(ctx, serviceAccount)).To(Succeed())
+		})
+
+		It("reports the missing service account on the binding", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			condition := getReadyCondition(binding)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+			Expect(condition.Reason).To(Equal(controllers.ReasonServiceAccountNotFound))
+			Expect(condition.Message).To(Equal(fmt.Sprintf("ServiceAccount %q does not exist", serviceAccountName)))
+		})
+	})
+})
+
+var _ = Describe("Service Account Controller without bindings", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		timeout  = time.Second * 10
+		interval = time.Millisecond * 250
+
+		secretName string
+	)
+
+	SetDefaultEventuallyPollingInterval(interval)
+	SetDefaultEventuallyTimeout(timeout)
+
+	getCredentialsAudience := func() (string, error) {
+		secret := &corev1.Secret{}
+		err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, secret)
+		if err != nil {
+			return "", err
+		}
+
+		config, err := credentialconfig.Parse(secret.Data[controllers.SecretKeyGoogleApplicationCredentials])
+		if err != nil {
+			return "", err
+		}
+
+		return config.Audience, nil
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		secretName = controllers.DefaultCredentialsSecretName("the-service-account")
+
+		tests.EnsureMembershipSecretExists(k8sClient, "old.svc.id.goog", "https://old.default.local")
+
+		// The binding kind is not registered, so that listing bindings fails
+		// like in a workload cluster without the binding CRD.
+		schemeWithoutBindings := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(schemeWithoutBindings))
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:             schemeWithoutBindings,
+			MetricsBindAddress: "0",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		membershipStore := controllers.NewMembershipStore(mgr.GetClient(), mgr.GetCache(), ctrl.Log.WithName("membership-store"))
+		Expect(mgr.Add(membershipStore)).To(Succeed())
+
+		reconciler := &controllers.ServiceAccountReconciler{
+			Client:          mgr.GetClient(),
+			Logger:          ctrl.Log.WithName("service-account-reconciler"),
+			Scheme:          schemeWithoutBindings,
+			Recorder:        mgr.GetEventRecorderFor("workload-identity-operator-gcp"),
+			Membership:      membershipStore,
+			DisableBindings: true,
+		}
+		Expect(reconciler.SetupWithManager(mgr)).To(Succeed())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+
+		serviceAccount := &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "the-service-account",
+				Namespace: namespace,
+				Annotations: map[string]string{
+					controllers.AnnotationGCPServiceAccount: "service-account@email",
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+
+		Eventually(getCredentialsAudience).Should(Equal("identitynamespace:old.svc.id.goog:https://old.default.local"))
+	})
+
+	AfterEach(func() {
+		cancel()
+
+		membershipSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			},
+		}
+		Expect(k8sClient.Delete(context.Background(), membershipSecret)).To(Succeed())
+	})
+
+	When("the membership changes", func() {
+		BeforeEach(func() {
+			membershipSecret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			}, membershipSecret)).To(Succeed())
+
+			membershipSecret.Data[controllers.SecretKeyGoogleApplicationCredentials] = []byte(
+				`{"workloadIdentityPool":"new.svc.id.goog","identityProvider":"https://new.default.local"}`,
+			)
+			Expect(k8sClient.Update(ctx, membershipSecret)).To(Succeed())
+		})
+
+		It("regenerates the credentials of the annotated service accounts", func() {
+			Eventually(getCredentialsAudience).Should(Equal("identitynamespace:new.svc.id.goog:https://new.default.local"))
+		})
+	})
+})
+
+var _ = Describe("Workload Identity Binding Controller", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		timeout  = time.Second * 10
+		interval = time.Millisecond * 250
+
+		serviceAccountName string
+		secretName         string
+	)
+
+	SetDefaultEventuallyPollingInterval(interval)
+	SetDefaultEventuallyTimeout(timeout)
+
+	getCredentialsSecret := func() error {
+		return k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, &corev1.Secret{})
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		serviceAccountName = "the-late-service-account"
+		secretName = controllers.DefaultCredentialsSecretName(serviceAccountName)
+
+		tests.EnsureMembershipSecretExists(k8sClient, "binding.svc.id.goog", "https://binding.default.local")
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:             scheme,
+			MetricsBindAddress: "0",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		membershipStore := controllers.NewMembershipStore(mgr.GetClient(), mgr.GetCache(), ctrl.Log.WithName("membership-store"))
+		Expect(mgr.Add(membershipStore)).To(Succeed())
+
+		reconciler := &controllers.ServiceAccountReconciler{
+			Client:     mgr.GetClient(),
+			Logger:     ctrl.Log.WithName("service-account-reconciler"),
+			Scheme:     scheme,
+			Recorder:   mgr.GetEventRecorderFor("workload-identity-operator-gcp"),
+			Membership: membershipStore,
+		}
+		Expect(reconciler.SetupWithManager(mgr)).To(Succeed())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+
+		binding := &v1alpha1.WorkloadIdentityBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "the-early-binding",
+				Namespace: namespace,
+			},
+			Spec: v1alpha1.WorkloadIdentityBindingSpec{
+				ServiceAccountName: serviceAccountName,
+				GCPServiceAccount:  "bound@project.iam.gserviceaccount.com",
+			},
+		}
+		Expect(k8sClient.Create(ctx, binding)).To(Succeed())
+
+		// The status update of the binding does not trigger another
+		// reconciliation, so the service account is only reconciled again
+		// when it is created.
+		Eventually(func() string {
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(binding), binding)).To(Succeed())
+			condition := meta.FindStatusCondition(binding.Status.Conditions, controllers.ConditionReady)
+			if condition == nil {
+				return ""
+			}
+			return condition.Reason
+		}).Should(Equal(controllers.ReasonServiceAccountNotFound))
+	})
+
+	AfterEach(func() {
+		cancel()
+
+		membershipSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			},
+		}
+		Expect(k8sClient.Delete(context.Background(), membershipSecret)).To(Succeed())
+	})
+
+	When("the service account is created after the binding", func() {
+		BeforeEach(func() {
+			serviceAccount := &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      serviceAccountName,
+					Namespace: namespace,
+				},
+			}
+			Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+		})
+
+		It("generates the credentials of the bound service account", func() {
+			Eventually(getCredentialsSecret).Should(Succeed())
+		})
+	})
+})
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/rest"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+)
+
+var (
+	// ManagedSecretSelector selects the Secrets created by the operator.
+	ManagedSecretSelector = labels.SelectorFromSet(labels.Set{
+		LabelSecretManagedBy: SecretManagedBy,
+	})
+
+	// KubeconfigSecretSelector selects the Secrets written by Cluster API
+	// for its clusters, which include their kubeconfig.
+	KubeconfigSecretSelector = labels.NewSelector().Add(mustRequirement(capi.ClusterLabelName, selection.Exists))
+
+	// MembershipSecretSelector selects the default membership Secret.
+	MembershipSecretSelector = fields.OneTermEqualSelector("metadata.name", MembershipSecretName)
+)
+
+// NewCacheFunc returns a cache.NewCacheFunc only caching the Secrets
+// matching the given selector. Clusters hold many large Secrets the operator
+// doesn't need, e.g. TLS certificates and Helm releases, and caching all of
+// them gets the operator OOM-killed on busy clusters. Unless all namespaces
+// are watched, the cache is also restricted to the watched namespaces.
+func NewCacheFunc(namespaces WatchedNamespaces, secretSelector labels.Selector) cache.NewCacheFunc {
+	return func(config *rest.Config, options cache.Options) (cache.Cache, error) {
+		options.SelectorsByObject = cache.SelectorsByObject{
+			&corev1.Secret{}: {Label: secretSelector},
+		}
+
+		if namespaces.All() {
+			return cache.New(config, options)
+		}
+
+		return cache.MultiNamespacedCacheBuilder(namespaces)(config, options)
+	}
+}
+
+// NewMembershipCluster returns a Cluster caching the default membership
+// Secret. The membership Secrets are written by fleet-membership-operator-gcp
+// and aren't labelled, so the cache selects the default one by name instead
+// of caching all the Secrets of the membership namespace. Named memberships
+// are read through the APIReader of the Cluster.
+func NewMembershipCluster(config *rest.Config, scheme *runtime.Scheme) (cluster.Cluster, error) {
+	return cluster.New(config, func(options *cluster.Options) {
+		options.Scheme = scheme
+		options.Namespace = DefaultMembershipSecretNamespace
+		options.NewCache = cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.Secret{}: {Field: MembershipSecretSelector},
+			},
+		})
+	})
+}
+
+func mustRequirement(key string, operator selection.Operator, values ...string) labels.Requirement {
+	requirement, err := labels.NewRequirement(key, operator, values)
+	if err != nil {
+		panic(err)
+	}
+
+	return *requirement
+}
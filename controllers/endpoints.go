@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
+)
+
+const (
+	// AnnotationGCPTokenURL, AnnotationGCPIAMCredentialsEndpoint and
+	// AnnotationGCPUniverseDomain override the global Endpoints for all the
+	// ServiceAccounts of an annotated Namespace.
+	AnnotationGCPTokenURL               = "giantswarm.io/gcp-token-url" //#nosec G101
+	AnnotationGCPIAMCredentialsEndpoint = "giantswarm.io/gcp-iam-credentials-endpoint"
+	AnnotationGCPUniverseDomain         = "giantswarm.io/gcp-universe-domain"
+)
+
+// Endpoints are the Google API endpoints used by the generated credentials.
+// Empty endpoints are derived from the universe domain, which defaults to
+// googleapis.com.
+type Endpoints struct {
+	TokenURL               string
+	IAMCredentialsEndpoint string
+	UniverseDomain         string
+}
+
+// WithNamespaceOverrides returns the Endpoints overridden by the annotations
+// of a Namespace.
+func (e Endpoints) WithNamespaceOverrides(annotations map[string]string) Endpoints {
+	if value, ok := annotations[AnnotationGCPTokenURL]; ok {
+		e.TokenURL = value
+	}
+
+	if value, ok := annotations[AnnotationGCPIAMCredentialsEndpoint]; ok {
+		e.IAMCredentialsEndpoint = value
+	}
+
+	if value, ok := annotations[AnnotationGCPUniverseDomain]; ok {
+		e.UniverseDomain = value
+	}
+
+	return e
+}
+
+// Validate checks that credentials can be generated with the Endpoints.
+func (e Endpoints) Validate() error {
+	_, err := e.apply(credentialconfig.NewBuilder("validation", "validation")).
+		WithServiceAccountImpersonation("validation@validation.iam.gserviceaccount.com").
+		Build()
+
+	return err
+}
+
+// apply configures the credential configuration builder with the endpoints.
+func (e Endpoints) apply(builder *credentialconfig.Builder) *credentialconfig.Builder {
+	tokenURL := e.TokenURL
+	if isEmpty(tokenURL) {
+		tokenURL = fmt.Sprintf("https://sts.%s/v1/token", e.universeDomain())
+	}
+
+	return builder.
+		WithTokenURL(tokenURL).
+		WithIAMCredentialsEndpoint(e.IAMCredentials()).
+		WithUniverseDomain(e.UniverseDomain)
+}
+
+// IAMCredentials returns the endpoint of the IAM credentials API, derived
+// from the universe domain when it is not set.
+func (e Endpoints) IAMCredentials() string {
+	if !isEmpty(e.IAMCredentialsEndpoint) {
+		return e.IAMCredentialsEndpoint
+	}
+
+	return fmt.Sprintf("https://iamcredentials.%s", e.universeDomain())
+}
+
+func (e Endpoints) universeDomain() string {
+	if isEmpty(e.UniverseDomain) {
+		return credentialconfig.DefaultUniverseDomain
+	}
+
+	return e.UniverseDomain
+}
@@ -0,0 +1,337 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/fleet-membership-operator-gcp/types"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	capg "sigs.k8s.io/cluster-api-provider-gcp/api/v1beta1"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// AnnotationWorkloadIdentityEnabled enables workload identity on the
+	// workload cluster of a GCPCluster.
+	AnnotationWorkloadIdentityEnabled = "giantswarm.io/workload-identity-enabled"
+
+	// KubeconfigNotFoundRequeueAfter is the delay before checking again for
+	// the kubeconfig of a workload cluster that is still being created.
+	KubeconfigNotFoundRequeueAfter = time.Minute
+
+	// MembershipResyncPeriod is the delay before checking again the
+	// membership Secret pushed into a workload cluster, as changes made in
+	// the workload cluster are not watched.
+	MembershipResyncPeriod = 5 * time.Minute
+
+	EventReasonMembershipSynced     = "MembershipSynced"
+	EventReasonMembershipSyncFailed = "MembershipSyncFailed"
+	EventReasonMembershipConflict   = "MembershipConflict"
+	EventReasonNamespaceCreated     = "NamespaceCreated"
+)
+
+// GCPClusterReconciler runs on management clusters. It derives the fleet
+// membership of the workload clusters from their GCPCluster and pushes it
+// into the workload cluster, where it is picked up by the operator running
+// there instead of the membership written by fleet-membership-operator-gcp.
+type GCPClusterReconciler struct {
+	client.Client
+	// APIReader reads the kubeconfig Secrets, which aren't cached. Defaults
+	// to the Client.
+	APIReader client.Reader
+	Scheme    *runtime.Scheme
+	Logger    logr.Logger
+	Recorder  record.EventRecorder
+
+	mutex sync.Mutex
+	// clients caches the clients of the workload clusters by GCPCluster, so
+	// that their API discovery is only done again when their kubeconfig
+	// changes.
+	clients map[k8stypes.NamespacedName]*cachedClient
+}
+
+type cachedClient struct {
+	kubeconfig []byte
+	client     client.Client
+}
+
+//+kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=gcpclusters,verbs=get;list;watch
+
+func (r *GCPClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Logger.WithValues("gcp-cluster", req.NamespacedName)
+
+	gcpCluster := &capg.GCPCluster{}
+	err := r.Get(ctx, req.NamespacedName, gcpCluster)
+	if err != nil {
+		logger.Error(err, "could not get gcp cluster")
+		if k8serrors.IsNotFound(err) {
+			r.forgetWorkloadCluster(req.NamespacedName)
+		}
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !gcpCluster.DeletionTimestamp.IsZero() {
+		logger.Info("Skipping GCPCluster being deleted")
+		r.forgetWorkloadCluster(req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+
+	if gcpCluster.Annotations[AnnotationWorkloadIdentityEnabled] != "true" {
+		logger.Info(fmt.Sprintf("Skipping GCPCluster without %q annotation", AnnotationWorkloadIdentityEnabled))
+		r.forgetWorkloadCluster(req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+
+	if isEmpty(gcpCluster.Spec.Project) {
+		message := "GCPCluster does not have a project"
+		logger.Info(message)
+		r.Recorder.Event(gcpCluster, corev1.EventTypeWarning, EventReasonMembershipSyncFailed, message)
+		return reconcile.Result{}, nil
+	}
+
+	clusterName := ClusterName(gcpCluster)
+	workloadClusterClient, err := r.workloadClusterClient(ctx, req.NamespacedName, clusterName)
+	if k8serrors.IsNotFound(err) {
+		logger.Info("Kubeconfig of the workload cluster does not exist yet")
+		return reconcile.Result{RequeueAfter: KubeconfigNotFoundRequeueAfter}, nil
+	}
+	if err != nil {
+		logger.Error(err, "failed to create workload cluster client")
+		return reconcile.Result{}, err
+	}
+
+	membership := GCPClusterMembership(gcpCluster.Spec.Project, clusterName)
+
+	err = r.syncMembership(ctx, gcpCluster, workloadClusterClient, membership)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// The membership Secret may be modified or deleted in the workload
+	// cluster, so it is checked again periodically.
+	return reconcile.Result{RequeueAfter: MembershipResyncPeriod}, nil
+}
+
+// syncMembership writes the membership Secret into the workload cluster. A
+// membership Secret that was not written by the operator, e.g. by
+// fleet-membership-operator-gcp, is left untouched.
+func (r *GCPClusterReconciler) syncMembership(ctx context.Context, gcpCluster *capg.GCPCluster, workloadClusterClient client.Client, membership types.MembershipData) error {
+	logger := r.Logger.WithValues("gcp-cluster", client.ObjectKeyFromObject(gcpCluster))
+
+	data, err := json.Marshal(membership)
+	if err != nil {
+		return err
+	}
+
+	existing := &corev1.Secret{}
+	err = workloadClusterClient.Get(ctx, client.ObjectKey{
+		Namespace: DefaultMembershipSecretNamespace,
+		Name:      MembershipSecretName,
+	}, existing)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		logger.Error(err, "failed to get membership secret")
+		return err
+	}
+
+	if k8serrors.IsNotFound(err) {
+		err = r.ensureNamespace(ctx, gcpCluster, workloadClusterClient)
+		if err != nil {
+			return err
+		}
+
+		membershipSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      MembershipSecretName,
+				Namespace: DefaultMembershipSecretNamespace,
+				Labels: map[string]string{
+					LabelSecretManagedBy: SecretManagedBy,
+				},
+				Annotations: map[string]string{
+					AnnotationSecretManagedBy: SecretManagedBy,
+				},
+			},
+			Data: map[string][]byte{
+				SecretKeyGoogleApplicationCredentials: data,
+			},
+		}
+
+		err = workloadClusterClient.Create(ctx, membershipSecret)
+		if err != nil {
+			logger.Error(err, "failed to create membership secret")
+			r.Recorder.Eventf(gcpCluster, corev1.EventTypeWarning, EventReasonMembershipSyncFailed,
+				"Failed to create membership secret in the workload cluster: %s", err)
+			return err
+		}
+
+		r.Recorder.Eventf(gcpCluster, corev1.EventTypeNormal, EventReasonMembershipSynced,
+			"Created membership secret for workload identity pool %q in the workload cluster", membership.WorkloadIdentityPool)
+		return nil
+	}
+
+	if existing.Annotations[AnnotationSecretManagedBy] != SecretManagedBy {
+		message := fmt.Sprintf("Membership secret %q in the workload cluster is not managed by %s", MembershipSecretName, SecretManagedBy)
+		logger.Info(message)
+		r.Recorder.Event(gcpCluster, corev1.EventTypeWarning, EventReasonMembershipConflict, message)
+		return nil
+	}
+
+	updated := existing.DeepCopy()
+	if updated.Labels == nil {
+		updated.Labels = map[string]string{}
+	}
+	updated.Labels[LabelSecretManagedBy] = SecretManagedBy
+
+	if updated.Data == nil {
+		updated.Data = map[string][]byte{}
+	}
+	updated.Data[SecretKeyGoogleApplicationCredentials] = data
+
+	if equality.Semantic.DeepEqual(existing, updated) {
+		return nil
+	}
+
+	err = workloadClusterClient.Update(ctx, updated)
+	if err != nil {
+		logger.Error(err, "failed to update membership secret")
+		r.Recorder.Eventf(gcpCluster, corev1.EventTypeWarning, EventReasonMembershipSyncFailed,
+			"Failed to update membership secret in the workload cluster: %s", err)
+		return err
+	}
+
+	r.Recorder.Eventf(gcpCluster, corev1.EventTypeNormal, EventReasonMembershipSynced,
+		"Updated membership secret for workload identity pool %q in the workload cluster", membership.WorkloadIdentityPool)
+	return nil
+}
+
+// ensureNamespace creates the namespace of the membership Secret in the
+// workload cluster if it doesn't exist yet, e.g. when the cluster has just
+// been created.
+func (r *GCPClusterReconciler) ensureNamespace(ctx context.Context, gcpCluster *capg.GCPCluster, workloadClusterClient client.Client) error {
+	logger := r.Logger.WithValues("gcp-cluster", client.ObjectKeyFromObject(gcpCluster))
+
+	namespace := &corev1.Namespace{}
+	err := workloadClusterClient.Get(ctx, client.ObjectKey{Name: DefaultMembershipSecretNamespace}, namespace)
+	if !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	namespace = &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: DefaultMembershipSecretNamespace,
+		},
+	}
+	err = workloadClusterClient.Create(ctx, namespace)
+	if k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "failed to create membership namespace")
+		r.Recorder.Eventf(gcpCluster, corev1.EventTypeWarning, EventReasonMembershipSyncFailed,
+			"Failed to create namespace %q for the membership secret in the workload cluster: %s", DefaultMembershipSecretNamespace, err)
+		return err
+	}
+
+	r.Recorder.Eventf(gcpCluster, corev1.EventTypeNormal, EventReasonNamespaceCreated,
+		"Created namespace %q for the membership secret in the workload cluster", DefaultMembershipSecretNamespace)
+	return nil
+}
+
+// workloadClusterClient returns a client for the workload cluster, using the
+// kubeconfig Secret written by Cluster API. Clients are reused until the
+// kubeconfig changes.
+func (r *GCPClusterReconciler) workloadClusterClient(ctx context.Context, key k8stypes.NamespacedName, clusterName string) (client.Client, error) {
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+
+	kubeconfigSecret := &corev1.Secret{}
+	err := reader.Get(ctx, client.ObjectKey{
+		Namespace: key.Namespace,
+		Name:      secret.Name(clusterName, secret.Kubeconfig),
+	}, kubeconfigSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	kubeconfig := kubeconfigSecret.Data[secret.KubeconfigDataName]
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cached, ok := r.clients[key]
+	if ok && bytes.Equal(cached.kubeconfig, kubeconfig) {
+		return cached.client, nil
+	}
+
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig for cluster %q: %w", clusterName, err)
+	}
+
+	workloadClient, err := client.New(restConfig, client.Options{Scheme: r.Scheme})
+	if err != nil {
+		return nil, err
+	}
+
+	if r.clients == nil {
+		r.clients = map[k8stypes.NamespacedName]*cachedClient{}
+	}
+	r.clients[key] = &cachedClient{
+		kubeconfig: kubeconfig,
+		client:     workloadClient,
+	}
+
+	return workloadClient, nil
+}
+
+// forgetWorkloadCluster drops the cached client of the workload cluster of
+// the given GCPCluster.
+func (r *GCPClusterReconciler) forgetWorkloadCluster(key k8stypes.NamespacedName) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.clients, key)
+}
+
+// ClusterName returns the name of the Cluster API cluster of the GCPCluster.
+func ClusterName(gcpCluster *capg.GCPCluster) string {
+	name, ok := gcpCluster.Labels[capi.ClusterLabelName]
+	if ok && !isEmpty(name) {
+		return name
+	}
+
+	return gcpCluster.Name
+}
+
+// GCPClusterMembership returns the fleet membership of the workload cluster
+// with the given name, registered in the fleet of the given project.
+func GCPClusterMembership(project, clusterName string) types.MembershipData {
+	return types.MembershipData{
+		WorkloadIdentityPool: fmt.Sprintf("%s.svc.id.goog", project),
+		IdentityProvider:     fmt.Sprintf("https://gkehub.googleapis.com/projects/%s/locations/global/memberships/%s", project, clusterName),
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *GCPClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&capg.GCPCluster{}).
+		Complete(r)
+}
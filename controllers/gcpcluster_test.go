@@ -0,0 +1,195 @@
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	capg "sigs.k8s.io/cluster-api-provider-gcp/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+)
+
+var _ = Describe("GCP Cluster Reconcilation", func() {
+	var (
+		ctx context.Context
+
+		gcpCluster *capg.GCPCluster
+
+		reconciler  *controllers.GCPClusterReconciler
+		recorder    *record.FakeRecorder
+		result      reconcile.Result
+		reconcilErr error
+	)
+
+	getMembershipSecret := func() (*corev1.Secret, error) {
+		membershipSecret := &corev1.Secret{}
+		err := k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: controllers.DefaultMembershipSecretNamespace,
+			Name:      controllers.MembershipSecretName,
+		}, membershipSecret)
+		return membershipSecret, err
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		gcpCluster = &capg.GCPCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "the-gcp-cluster",
+				Namespace: namespace,
+				Labels: map[string]string{
+					"cluster.x-k8s.io/cluster-name": "the-cluster",
+				},
+				Annotations: map[string]string{
+					controllers.AnnotationWorkloadIdentityEnabled: "true",
+				},
+			},
+			Spec: capg.GCPClusterSpec{
+				Project: "the-project",
+				Region:  "europe-west3",
+			},
+		}
+		Expect(k8sClient.Create(ctx, gcpCluster)).To(Succeed())
+
+		// The test environment acts as both the management and the workload
+		// cluster.
+		kubeconfig, err := KubeConfigFromREST(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		kubeconfigSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "the-cluster-kubeconfig",
+				Namespace: namespace,
+			},
+			Data: map[string][]byte{
+				"value": kubeconfig,
+			},
+		}
+		Expect(k8sClient.Create(ctx, kubeconfigSecret)).To(Succeed())
+
+		recorder = record.NewFakeRecorder(100)
+		reconciler = &controllers.GCPClusterReconciler{
+			Client:   k8sClient,
+			Logger:   ctrl.Log.WithName("gcp-cluster-reconciler"),
+			Scheme:   scheme,
+			Recorder: recorder,
+		}
+	})
+
+	JustBeforeEach(func() {
+		result, reconcilErr = reconciler.Reconcile(ctx, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(gcpCluster),
+		})
+	})
+
+	AfterEach(func() {
+		membershipSecret, err := getMembershipSecret()
+		if k8serrors.IsNotFound(err) {
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(k8sClient.Delete(ctx, membershipSecret)).To(Succeed())
+	})
+
+	It("pushes the membership into the workload cluster", func() {
+		Expect(reconcilErr).NotTo(HaveOccurred())
+
+		membershipSecret, err := getMembershipSecret()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(membershipSecret.Annotations).To(HaveKeyWithValue(controllers.AnnotationSecretManagedBy, controllers.SecretManagedBy))
+
+		membership, err := controllers.ParseMembership(membershipSecret)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(membership.WorkloadIdentityPool).To(Equal("the-project.svc.id.goog"))
+		Expect(membership.IdentityProvider).To(Equal("https://gkehub.googleapis.com/projects/the-project/locations/global/memberships/the-cluster"))
+
+		Expect(recorder.Events).To(Receive(HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeNormal, controllers.EventReasonMembershipSynced))))
+	})
+
+	It("checks the membership again periodically", func() {
+		Expect(reconcilErr).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(controllers.MembershipResyncPeriod))
+	})
+
+	When("the membership secret is deleted from the workload cluster", func() {
+		JustBeforeEach(func() {
+			membershipSecret, err := getMembershipSecret()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Delete(ctx, membershipSecret)).To(Succeed())
+
+			result, reconcilErr = reconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: client.ObjectKeyFromObject(gcpCluster),
+			})
+		})
+
+		It("pushes the membership again", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			_, err := getMembershipSecret()
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	When("the gcp cluster is not annotated", func() {
+		BeforeEach(func() {
+			gcpCluster.Annotations = nil
+			Expect(k8sClient.Update(ctx, gcpCluster)).To(Succeed())
+		})
+
+		It("does not push the membership", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			_, err := getMembershipSecret()
+			Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	When("the membership secret is not managed by the operator", func() {
+		BeforeEach(func() {
+			membershipSecret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      controllers.MembershipSecretName,
+					Namespace: controllers.DefaultMembershipSecretNamespace,
+				},
+				StringData: map[string]string{
+					controllers.SecretKeyGoogleApplicationCredentials: `{"workloadIdentityPool":"fleet.svc.id.goog","identityProvider":"https://fleet"}`,
+				},
+			}
+			Expect(k8sClient.Create(ctx, membershipSecret)).To(Succeed())
+		})
+
+		It("leaves the membership untouched", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+
+			membershipSecret, err := getMembershipSecret()
+			Expect(err).NotTo(HaveOccurred())
+
+			membership, err := controllers.ParseMembership(membershipSecret)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(membership.WorkloadIdentityPool).To(Equal("fleet.svc.id.goog"))
+
+			Expect(recorder.Events).To(Receive(HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeWarning, controllers.EventReasonMembershipConflict))))
+		})
+	})
+
+	When("the kubeconfig of the workload cluster does not exist yet", func() {
+		BeforeEach(func() {
+			gcpCluster.Labels = nil
+			Expect(k8sClient.Update(ctx, gcpCluster)).To(Succeed())
+		})
+
+		It("checks again later", func() {
+			Expect(reconcilErr).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(controllers.KubeconfigNotFoundRequeueAfter))
+		})
+	})
+})
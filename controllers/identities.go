@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
+)
+
+const (
+	// AnnotationGCPAdditionalServiceAccounts lists, as a comma separated
+	// list, the GCP service accounts the containers of the Pods of a
+	// ServiceAccount can impersonate instead of the one of the
+	// ServiceAccount. A credentials Secret is generated for each of them.
+	AnnotationGCPAdditionalServiceAccounts = "giantswarm.io/gcp-additional-service-accounts"
+
+	// AnnotationSecretIdentity is set on the credentials Secrets of the
+	// container identities to the GCP service account they impersonate.
+	AnnotationSecretIdentity = "giantswarm.io/gcp-identity" //#nosec G101
+)
+
+// AdditionalServiceAccounts parses the sorted GCP service accounts of the
+// AnnotationGCPAdditionalServiceAccounts annotation.
+func AdditionalServiceAccounts(annotations map[string]string) ([]string, error) {
+	serviceAccounts := map[string]bool{}
+	for _, serviceAccount := range strings.Split(annotations[AnnotationGCPAdditionalServiceAccounts], ",") {
+		serviceAccount = strings.TrimSpace(serviceAccount)
+		if serviceAccount == "" {
+			continue
+		}
+
+		err := credentialconfig.ValidateServiceAccount(serviceAccount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q annotation: %w", AnnotationGCPAdditionalServiceAccounts, err)
+		}
+
+		serviceAccounts[serviceAccount] = true
+	}
+
+	result := make([]string, 0, len(serviceAccounts))
+	for serviceAccount := range serviceAccounts {
+		result = append(result, serviceAccount)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// IdentitySecretName returns the name of the credentials Secret impersonating
+// the given GCP service account, derived from the name of the credentials
+// Secret of the ServiceAccount.
+func IdentitySecretName(secretName, serviceAccount string) string {
+	hash := sha256.Sum256([]byte(serviceAccount))
+	return fmt.Sprintf("%s-%s", secretName, hex.EncodeToString(hash[:])[:10])
+}
+
+// syncIdentitySecrets generates the credentials Secrets of the container
+// identities of the ServiceAccount from its credential configuration, so
+// that they use the same audience, endpoints and options. The IAM
+// credentials endpoint is taken from the given Endpoints, as the
+// configuration of a ServiceAccount using direct resource access doesn't
+// hold it. The Secrets of the identities that are no longer listed are
+// deleted.
+func (r *ServiceAccountReconciler) syncIdentitySecrets(ctx context.Context, serviceAccount *corev1.ServiceAccount, secretName string, config *credentialconfig.Config, endpoints Endpoints, identities []string) error {
+	logger := r.Logger.WithValues("service-account", client.ObjectKeyFromObject(serviceAccount))
+
+	expected := map[string]bool{}
+	for _, identity := range identities {
+		name := IdentitySecretName(secretName, identity)
+		expected[name] = true
+
+		identityConfig, err := config.Impersonating(endpoints.IAMCredentials(), identity)
+		if err != nil {
+			return err
+		}
+
+		data, err := identityConfig.Marshal()
+		if err != nil {
+			logger.Error(err, "failed to marshal credential configuration", "identity", identity)
+			return err
+		}
+
+		secret := &corev1.Secret{}
+		err = r.getSecret(ctx, k8stypes.NamespacedName{
+			Name:      name,
+			Namespace: serviceAccount.Namespace,
+		}, secret)
+		if k8serrors.IsNotFound(err) {
+			newSecret, err := r.generateNewSecret(serviceAccount, name, data)
+			if err != nil {
+				return err
+			}
+			newSecret.Annotations[AnnotationSecretIdentity] = identity
+
+			err = r.createSecret(ctx, serviceAccount, newSecret)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			logger.Error(err, "failed to get secret", "secret", name)
+			return err
+		}
+
+		if !isManagedSecret(secret, serviceAccount) {
+			return fmt.Errorf("secret %q already exists and is not managed by %s", name, SecretManagedBy)
+		}
+
+		updatedSecret, err := r.syncSecret(serviceAccount, secret, data)
+		if err != nil {
+			return err
+		}
+		updatedSecret.Annotations[AnnotationSecretIdentity] = identity
+
+		if !equality.Semantic.DeepEqual(secret, updatedSecret) {
+			err = r.updateSecret(ctx, serviceAccount, updatedSecret)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return r.deleteIdentitySecrets(ctx, serviceAccount, expected)
+}
+
+// deleteIdentitySecrets deletes the credentials Secrets of the container
+// identities of the ServiceAccount whose name is not in the keep set.
+func (r *ServiceAccountReconciler) deleteIdentitySecrets(ctx context.Context, serviceAccount *corev1.ServiceAccount, keep map[string]bool) error {
+	secrets := &corev1.SecretList{}
+	err := r.List(ctx, secrets,
+		client.InNamespace(serviceAccount.Namespace),
+		client.MatchingLabels{LabelSecretManagedBy: SecretManagedBy},
+	)
+	if err != nil {
+		r.Logger.Error(err, "failed to list secrets", "namespace", serviceAccount.Namespace)
+		return err
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if _, ok := secret.Annotations[AnnotationSecretIdentity]; !ok || keep[secret.Name] || !isManagedSecret(secret, serviceAccount) {
+			continue
+		}
+
+		err = r.Delete(ctx, secret, client.Preconditions{UID: &secret.UID})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			r.Recorder.Eventf(serviceAccount, corev1.EventTypeWarning, EventReasonSecretSyncFailed,
+				"Failed to delete credentials secret %q: %s", secret.Name, err)
+			return err
+		}
+
+		secretOperationsTotal.WithLabelValues(r.clusterName(), SecretOperationDeleted).Inc()
+		r.Recorder.Eventf(serviceAccount, corev1.EventTypeNormal, EventReasonSecretDeleted,
+			"Deleted credentials secret %q", secret.Name)
+	}
+
+	return nil
+}
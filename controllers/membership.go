@@ -0,0 +1,443 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/fleet-membership-operator-gcp/types"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+const (
+	// AnnotationGCPMembership selects the named membership used by a
+	// ServiceAccount, or by all the ServiceAccounts of a Namespace.
+	AnnotationGCPMembership = "giantswarm.io/gcp-membership"
+
+	// DefaultMembershipName is the name of the membership stored in the
+	// MembershipSecretName Secret.
+	DefaultMembershipName = ""
+
+	// NamedMembershipRefreshPeriod is the period at which the named
+	// memberships are read again from their Secrets. Only the default
+	// membership Secret is watched.
+	NamedMembershipRefreshPeriod = time.Minute
+)
+
+// ErrMembershipNotLoaded is returned by the MembershipStore when no valid
+// membership has been observed yet.
+var ErrMembershipNotLoaded = errors.New("membership has not been loaded yet")
+
+// MembershipStore keeps the parsed fleet membership in memory so that
+// consumers, like the webhook and the ServiceAccountReconciler, don't need
+// to fetch and unmarshal the membership Secret every time they need it.
+//
+// A cluster can be a member of several fleets. Besides the default
+// membership, named memberships are stored in Secrets called
+// MembershipSecretName-<name>. The store holds all of them, keyed by name.
+//
+// The default membership is kept up to date by an event handler on the
+// Secret informer. Named memberships are read uncached with the given reader
+// when first used, and read again every NamedMembershipRefreshPeriod while
+// the store runs, so that the informer doesn't need to cache all the Secrets
+// of the membership namespace. Consumers are notified of the changes of both.
+// The store always holds the last known good memberships: a Secret that
+// can't be parsed or that is deleted does not replace a previously loaded
+// value.
+//
+// In standalone mode, the store doesn't read any membership and always
+// resolves to the configured WorkloadIdentityProvider.
+type MembershipStore struct {
+	reader   client.Reader
+	cache    cache.Cache
+	logger   logr.Logger
+	provider *WorkloadIdentityProvider
+
+	mutex       sync.RWMutex
+	memberships map[string]types.MembershipData
+	updated     map[string]time.Time
+	stale       map[string]bool
+
+	changes chan event.GenericEvent
+}
+
+func NewMembershipStore(reader client.Reader, cache cache.Cache, logger logr.Logger) *MembershipStore {
+	return &MembershipStore{
+		reader: reader,
+		cache:  cache,
+		logger: logger,
+
+		memberships: map[string]types.MembershipData{},
+		updated:     map[string]time.Time{},
+		stale:       map[string]bool{},
+
+		// A single pending notification is enough, as consumers re-read the
+		// whole membership when notified.
+		changes: make(chan event.GenericEvent, 1),
+	}
+}
+
+// NewStandaloneMembershipStore returns a MembershipStore that resolves every
+// ServiceAccount to the given provider, without fleet-membership-operator-gcp.
+func NewStandaloneMembershipStore(provider WorkloadIdentityProvider, logger logr.Logger) *MembershipStore {
+	store := NewMembershipStore(nil, nil, logger)
+	store.provider = &provider
+	store.updated[DefaultMembershipName] = time.Now()
+
+	return store
+}
+
+// Standalone reports whether the store runs in standalone mode.
+func (s *MembershipStore) Standalone() bool {
+	return s.provider != nil
+}
+
+// Federation returns the Federation of the membership with the given name.
+// In standalone mode, the name is ignored and the Federation of the
+// configured provider is returned.
+func (s *MembershipStore) Federation(ctx context.Context, name string) (Federation, error) {
+	if s.provider != nil {
+		return s.provider.Federation(), nil
+	}
+
+	membership, err := s.GetNamed(ctx, name)
+	if err != nil {
+		return Federation{}, err
+	}
+
+	return MembershipFederation(membership), nil
+}
+
+// Get returns the last known good default membership. If it has not been
+// observed yet, it is loaded from the membership Secret.
+func (s *MembershipStore) Get(ctx context.Context) (types.MembershipData, error) {
+	return s.GetNamed(ctx, DefaultMembershipName)
+}
+
+// GetNamed returns the last known good membership with the given name. If it
+// has not been observed yet, it is loaded from its Secret.
+func (s *MembershipStore) GetNamed(ctx context.Context, name string) (types.MembershipData, error) {
+	if s.provider != nil {
+		return types.MembershipData{}, fmt.Errorf("%w: %s", ErrMembershipNotLoaded, errStandalone)
+	}
+
+	s.mutex.RLock()
+	membership, ok := s.memberships[name]
+	s.mutex.RUnlock()
+
+	if ok {
+		return membership, nil
+	}
+
+	loaded, err := GetNamedMembershipFromSecret(ctx, s.reader, s.logger, name)
+	if err != nil {
+		return types.MembershipData{}, fmt.Errorf("%w: %s", ErrMembershipNotLoaded, err)
+	}
+
+	s.set(name, loaded)
+	return loaded, nil
+}
+
+// Resync reads the named memberships the store holds again from their
+// Secrets and notifies the consumers of the ones that changed. It is called
+// every NamedMembershipRefreshPeriod by Start.
+func (s *MembershipStore) Resync(ctx context.Context) {
+	s.mutex.RLock()
+	names := make([]string, 0, len(s.memberships))
+	for name := range s.memberships {
+		if name != DefaultMembershipName {
+			names = append(names, name)
+		}
+	}
+	s.mutex.RUnlock()
+
+	for _, name := range names {
+		membership, err := GetNamedMembershipFromSecret(ctx, s.reader, s.logger, name)
+		if err != nil {
+			s.logger.Error(err, "failed to refresh membership, keeping last known good membership", "membership", name)
+			s.markStale(name)
+			continue
+		}
+
+		if !s.set(name, membership) {
+			continue
+		}
+
+		s.logger.Info("Membership updated", "membership", name, "workload-identity-pool", membership.WorkloadIdentityPool)
+		s.notify(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: DefaultMembershipSecretNamespace,
+				Name:      MembershipSecretNameFor(name),
+			},
+		})
+	}
+}
+
+// Loaded reports whether the store holds a valid default membership. It is
+// always true in standalone mode.
+func (s *MembershipStore) Loaded() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.updated[DefaultMembershipName]
+	return ok
+}
+
+// LastUpdated returns the time at which each loaded membership was loaded or
+// last changed, keyed by membership name.
+func (s *MembershipStore) LastUpdated() map[string]time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	updated := map[string]time.Time{}
+	for name, timestamp := range s.updated {
+		updated[name] = timestamp
+	}
+
+	return updated
+}
+
+// Stale returns the names of the loaded memberships whose Secret was deleted
+// or could not be parsed when last read. The store still serves their last
+// known good value.
+func (s *MembershipStore) Stale() map[string]bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	stale := map[string]bool{}
+	for name := range s.stale {
+		stale[name] = true
+	}
+
+	return stale
+}
+
+// Changes returns a channel that receives an event every time a membership
+// changes. Notifications are coalesced when the consumer is not keeping up.
+func (s *MembershipStore) Changes() <-chan event.GenericEvent {
+	return s.changes
+}
+
+// Start registers the event handlers that keep the default membership up to
+// date and resyncs the named memberships until ctx is done. It implements
+// manager.Runnable.
+func (s *MembershipStore) Start(ctx context.Context) error {
+	if s.provider != nil {
+		<-ctx.Done()
+		return nil
+	}
+
+	informer, err := s.cache.GetInformer(ctx, &corev1.Secret{})
+	if err != nil {
+		return err
+	}
+
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: s.onChange,
+		UpdateFunc: func(_, newObj interface{}) {
+			s.onChange(newObj)
+		},
+		DeleteFunc: s.onDelete,
+	})
+
+	ticker := time.NewTicker(NamedMembershipRefreshPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			s.Resync(ctx)
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. The store is
+// used by the webhook, which serves requests on every replica.
+func (s *MembershipStore) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *MembershipStore) onChange(obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+
+	name, ok := membershipName(secret)
+	if !ok {
+		return
+	}
+
+	membership, err := ParseMembership(secret)
+	if err != nil {
+		s.logger.Error(err, "ignoring invalid membership, keeping last known good membership", "membership", name)
+		s.markStale(name)
+		return
+	}
+
+	if !s.set(name, membership) {
+		return
+	}
+
+	s.logger.Info("Membership updated", "membership", name, "workload-identity-pool", membership.WorkloadIdentityPool)
+	s.notify(secret)
+}
+
+// notify sends a change notification for the given membership Secret,
+// unless one is already pending.
+func (s *MembershipStore) notify(secret *corev1.Secret) {
+	select {
+	case s.changes <- event.GenericEvent{Object: secret}:
+	default:
+	}
+}
+
+func (s *MembershipStore) onDelete(obj interface{}) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+
+	name, ok := membershipName(secret)
+	if !ok {
+		return
+	}
+
+	s.logger.Info("Membership secret deleted, keeping last known good membership", "membership", name)
+	s.markStale(name)
+}
+
+// set stores the given membership and reports whether it differs from the
+// previously stored one.
+func (s *MembershipStore) set(name string, membership types.MembershipData) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.stale, name)
+
+	current, ok := s.memberships[name]
+	if ok && reflect.DeepEqual(current, membership) {
+		return false
+	}
+
+	s.memberships[name] = membership
+	s.updated[name] = time.Now()
+	return true
+}
+
+// markStale records that the Secret of the membership with the given name
+// was deleted or could not be parsed, if the membership is loaded.
+func (s *MembershipStore) markStale(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.memberships[name]; ok {
+		s.stale[name] = true
+	}
+}
+
+// MembershipSecretNameFor returns the name of the Secret holding the
+// membership with the given name.
+func MembershipSecretNameFor(name string) string {
+	if name == DefaultMembershipName {
+		return MembershipSecretName
+	}
+
+	return fmt.Sprintf("%s-%s", MembershipSecretName, name)
+}
+
+// membershipName returns the name of the membership stored in the given
+// Secret, and whether it is a membership Secret at all.
+func membershipName(secret *corev1.Secret) (string, bool) {
+	if secret.Namespace != DefaultMembershipSecretNamespace {
+		return "", false
+	}
+
+	if secret.Name == MembershipSecretName {
+		return DefaultMembershipName, true
+	}
+
+	name := strings.TrimPrefix(secret.Name, MembershipSecretName+"-")
+	if name == secret.Name || name == "" {
+		return "", false
+	}
+
+	return name, true
+}
+
+// ResolveMembershipName returns the name of the membership used by the
+// ServiceAccount with the given annotations in the given Namespace. The
+// annotation of the ServiceAccount takes precedence over the annotation of
+// its Namespace. Both the reconciler and the webhook use it, so that the
+// audience of the projected token always matches the credentials.
+func ResolveMembershipName(ctx context.Context, c client.Client, namespace string, serviceAccountAnnotations map[string]string) (string, error) {
+	if name, ok := serviceAccountAnnotations[AnnotationGCPMembership]; ok {
+		return name, nil
+	}
+
+	namespaceObj := &corev1.Namespace{}
+	err := c.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)
+	if err != nil {
+		return "", err
+	}
+
+	return namespaceObj.Annotations[AnnotationGCPMembership], nil
+}
+
+func GetMembershipFromSecret(ctx context.Context, c client.Reader, logger logr.Logger) (types.MembershipData, error) {
+	return GetNamedMembershipFromSecret(ctx, c, logger, DefaultMembershipName)
+}
+
+func GetNamedMembershipFromSecret(ctx context.Context, c client.Reader, logger logr.Logger, name string) (types.MembershipData, error) {
+	secret := &corev1.Secret{}
+
+	err := c.Get(ctx, client.ObjectKey{
+		Namespace: DefaultMembershipSecretNamespace,
+		Name:      MembershipSecretNameFor(name),
+	}, secret)
+	if err != nil {
+		logger.Error(err, "failed to get membership secret", "membership", name)
+		return types.MembershipData{}, err
+	}
+
+	return ParseMembership(secret)
+}
+
+// ParseMembership unmarshals and validates the membership stored in the
+// given Secret.
+func ParseMembership(secret *corev1.Secret) (types.MembershipData, error) {
+	data := secret.Data[SecretKeyGoogleApplicationCredentials]
+
+	membership := types.MembershipData{}
+	err := json.Unmarshal(data, &membership)
+	if err != nil {
+		return types.MembershipData{}, err
+	}
+
+	if isEmpty(membership.IdentityProvider) {
+		return types.MembershipData{}, fmt.Errorf("membership does not have an identity provider %+v", membership)
+	}
+
+	if isEmpty(membership.WorkloadIdentityPool) {
+		return types.MembershipData{}, fmt.Errorf("membership does not have a workload identity pool %+v", membership)
+	}
+
+	return membership, nil
+}
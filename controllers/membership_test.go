@@ -0,0 +1,231 @@
+package controllers_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/giantswarm/fleet-membership-operator-gcp/types"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+	"github.com/giantswarm/workload-identity-operator-gcp/tests"
+)
+
+var _ = Describe("Membership Store", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		timeout  = time.Second * 5
+		interval = time.Millisecond * 250
+
+		workloadIdentityPool string
+		identityProvider     string
+
+		informerCache cache.Cache
+		store         *controllers.MembershipStore
+	)
+
+	SetDefaultConsistentlyDuration(timeout)
+	SetDefaultConsistentlyPollingInterval(interval)
+	SetDefaultEventuallyPollingInterval(interval)
+	SetDefaultEventuallyTimeout(timeout)
+
+	getMembershipSecret := func() *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			},
+		}
+	}
+
+	getMembership := func() types.MembershipData {
+		membership, err := store.Get(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return membership
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		workloadIdentityPool = "store.svc.id.goog"
+		identityProvider = "https://store.default.local"
+
+		var err error
+		informerCache, err = cache.New(cfg, cache.Options{
+			Scheme:    scheme,
+			Namespace: controllers.DefaultMembershipSecretNamespace,
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.Secret{}: {Field: controllers.MembershipSecretSelector},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			Expect(informerCache.Start(ctx)).To(Succeed())
+		}()
+		Expect(informerCache.WaitForCacheSync(ctx)).To(BeTrue())
+
+		store = controllers.NewMembershipStore(k8sClient, informerCache, ctrl.Log.WithName("membership-store"))
+		go func() {
+			defer GinkgoRecover()
+			Expect(store.Start(ctx)).To(Succeed())
+		}()
+	})
+
+	AfterEach(func() {
+		cancel()
+		Expect(client.IgnoreNotFound(k8sClient.Delete(context.Background(), getMembershipSecret()))).To(Succeed())
+
+		namedSecret := getMembershipSecret()
+		namedSecret.Name = controllers.MembershipSecretNameFor("other-fleet")
+		Expect(client.IgnoreNotFound(k8sClient.Delete(context.Background(), namedSecret))).To(Succeed())
+	})
+
+	When("the membership secret does not exist", func() {
+		It("reports the membership as not loaded", func() {
+			_, err := store.Get(ctx)
+			Expect(err).To(MatchError(controllers.ErrMembershipNotLoaded))
+			Expect(store.Loaded()).To(BeFalse())
+		})
+	})
+
+	When("the membership secret exists", func() {
+		BeforeEach(func() {
+			tests.EnsureMembershipSecretExists(k8sClient, workloadIdentityPool, identityProvider)
+		})
+
+		It("loads the membership", func() {
+			Eventually(store.Loaded).Should(BeTrue())
+			membership := getMembership()
+			Expect(membership.WorkloadIdentityPool).To(Equal(workloadIdentityPool))
+			Expect(membership.IdentityProvider).To(Equal(identityProvider))
+		})
+
+		When("the membership secret is updated", func() {
+			BeforeEach(func() {
+				Eventually(store.Loaded).Should(BeTrue())
+
+				secret := getMembershipSecret()
+				secret.StringData = map[string]string{
+					controllers.SecretKeyGoogleApplicationCredentials: `{"workloadIdentityPool":"new.svc.id.goog","identityProvider":"https://new.default.local"}`,
+				}
+				Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+			})
+
+			It("updates the membership", func() {
+				Eventually(func() string {
+					return getMembership().WorkloadIdentityPool
+				}).Should(Equal("new.svc.id.goog"))
+				Expect(getMembership().IdentityProvider).To(Equal("https://new.default.local"))
+			})
+		})
+
+		When("the membership secret is updated with an invalid membership", func() {
+			BeforeEach(func() {
+				Eventually(store.Loaded).Should(BeTrue())
+
+				secret := getMembershipSecret()
+				secret.StringData = map[string]string{
+					controllers.SecretKeyGoogleApplicationCredentials: `{"workloadIdentityPool":""}`,
+				}
+				Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+			})
+
+			It("keeps the last known good membership", func() {
+				Consistently(func() string {
+					return getMembership().WorkloadIdentityPool
+				}, time.Second).Should(Equal(workloadIdentityPool))
+			})
+		})
+
+		When("the membership secret is deleted", func() {
+			BeforeEach(func() {
+				Eventually(store.Loaded).Should(BeTrue())
+				Expect(k8sClient.Delete(ctx, getMembershipSecret())).To(Succeed())
+			})
+
+			It("keeps the last known good membership", func() {
+				Consistently(func() string {
+					return getMembership().WorkloadIdentityPool
+				}, time.Second).Should(Equal(workloadIdentityPool))
+			})
+
+			It("reports the membership as stale", func() {
+				Eventually(store.Stale).Should(HaveKey(controllers.DefaultMembershipName))
+			})
+		})
+	})
+
+	When("a named membership secret exists", func() {
+		BeforeEach(func() {
+			tests.EnsureNamedMembershipSecretExists(k8sClient, "other-fleet", "other.svc.id.goog", "https://other.default.local")
+		})
+
+		It("loads the membership without caching its secret", func() {
+			membership, err := store.GetNamed(ctx, "other-fleet")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(membership.WorkloadIdentityPool).To(Equal("other.svc.id.goog"))
+			Expect(membership.IdentityProvider).To(Equal("https://other.default.local"))
+
+			secret := &corev1.Secret{}
+			err = informerCache.Get(ctx, client.ObjectKey{
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+				Name:      controllers.MembershipSecretNameFor("other-fleet"),
+			}, secret)
+			Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		When("the named membership secret is updated", func() {
+			BeforeEach(func() {
+				_, err := store.GetNamed(ctx, "other-fleet")
+				Expect(err).NotTo(HaveOccurred())
+
+				secret := getMembershipSecret()
+				secret.Name = controllers.MembershipSecretNameFor("other-fleet")
+				secret.StringData = map[string]string{
+					controllers.SecretKeyGoogleApplicationCredentials: `{"workloadIdentityPool":"new.svc.id.goog","identityProvider":"https://new.default.local"}`,
+				}
+				Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+			})
+
+			It("updates the membership and notifies the change when resynced", func() {
+				store.Resync(ctx)
+
+				membership, err := store.GetNamed(ctx, "other-fleet")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(membership.WorkloadIdentityPool).To(Equal("new.svc.id.goog"))
+
+				Eventually(store.Changes()).Should(Receive())
+			})
+		})
+
+		When("the named membership secret is deleted", func() {
+			BeforeEach(func() {
+				_, err := store.GetNamed(ctx, "other-fleet")
+				Expect(err).NotTo(HaveOccurred())
+
+				secret := getMembershipSecret()
+				secret.Name = controllers.MembershipSecretNameFor("other-fleet")
+				Expect(k8sClient.Delete(ctx, secret)).To(Succeed())
+			})
+
+			It("keeps the last known good membership and reports it as stale when resynced", func() {
+				store.Resync(ctx)
+
+				membership, err := store.GetNamed(ctx, "other-fleet")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(membership.WorkloadIdentityPool).To(Equal("other.svc.id.goog"))
+				Expect(store.Stale()).To(HaveKey("other-fleet"))
+			})
+		})
+	})
+})
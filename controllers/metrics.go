@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	metricsNamespace = "workload_identity"
+
+	SecretOperationCreated = "created"
+	SecretOperationUpdated = "updated"
+	SecretOperationDeleted = "deleted"
+)
+
+var (
+	managedServiceAccountsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconciler",
+		Name:      "managed_service_accounts",
+		Help:      "Number of ServiceAccounts managed by the operator, by cluster and whether their credentials are in sync.",
+	}, []string{"cluster", "synced"})
+
+	secretOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconciler",
+		Name:      "secret_operations_total",
+		Help:      "Number of credentials Secrets created, updated and deleted.",
+	}, []string{"cluster", "operation"})
+
+	membershipErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconciler",
+		Name:      "membership_errors_total",
+		Help:      "Number of reconciliations that failed because the membership is not available.",
+	}, []string{"cluster"})
+
+	workloadClustersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "reconciler",
+		Name:      "workload_clusters",
+		Help:      "Number of remote workload clusters the ServiceAccounts are reconciled in.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		managedServiceAccountsGauge,
+		secretOperationsTotal,
+		membershipErrorsTotal,
+		workloadClustersGauge,
+	)
+}
+
+// managedServiceAccounts tracks the sync state of the managed
+// ServiceAccounts of every cluster to expose it as a gauge.
+var managedServiceAccounts = &serviceAccountTracker{
+	synced: map[string]map[k8stypes.NamespacedName]bool{},
+}
+
+type serviceAccountTracker struct {
+	mutex  sync.Mutex
+	synced map[string]map[k8stypes.NamespacedName]bool
+}
+
+func (t *serviceAccountTracker) set(cluster string, key k8stypes.NamespacedName, synced bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.synced[cluster] == nil {
+		t.synced[cluster] = map[k8stypes.NamespacedName]bool{}
+	}
+	t.synced[cluster][key] = synced
+	t.update(cluster)
+}
+
+func (t *serviceAccountTracker) remove(cluster string, key k8stypes.NamespacedName) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.synced[cluster], key)
+	t.update(cluster)
+}
+
+// removeCluster forgets all the ServiceAccounts of a cluster that is no
+// longer reconciled.
+func (t *serviceAccountTracker) removeCluster(cluster string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.synced, cluster)
+	for _, synced := range []bool{true, false} {
+		managedServiceAccountsGauge.DeleteLabelValues(cluster, strconv.FormatBool(synced))
+	}
+}
+
+func (t *serviceAccountTracker) update(cluster string) {
+	counts := map[bool]int{}
+	for _, synced := range t.synced[cluster] {
+		counts[synced]++
+	}
+
+	for _, synced := range []bool{true, false} {
+		managedServiceAccountsGauge.WithLabelValues(cluster, strconv.FormatBool(synced)).Set(float64(counts[synced]))
+	}
+}
+
+// NewMembershipCollector returns a collector exposing the state of the
+// memberships held by the given store, labelled with the cluster the store
+// reads them from.
+func NewMembershipCollector(cluster string, store *MembershipStore) prometheus.Collector {
+	clusterLabel := prometheus.Labels{"cluster": cluster}
+
+	return &membershipCollector{
+		store: store,
+		loaded: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "membership", "loaded"),
+			"Whether a valid membership is loaded from its Secret.",
+			[]string{"membership"}, clusterLabel,
+		),
+		age: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "membership", "age_seconds"),
+			"Time since the current membership was loaded or last changed.",
+			[]string{"membership"}, clusterLabel,
+		),
+	}
+}
+
+type membershipCollector struct {
+	store  *MembershipStore
+	loaded *prometheus.Desc
+	age    *prometheus.Desc
+}
+
+func (c *membershipCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.loaded
+	ch <- c.age
+}
+
+func (c *membershipCollector) Collect(ch chan<- prometheus.Metric) {
+	updated := c.store.LastUpdated()
+	stale := c.store.Stale()
+
+	// The default membership is always reported, so that alerts can fire
+	// when it has never been loaded.
+	if _, ok := updated[DefaultMembershipName]; !ok {
+		ch <- prometheus.MustNewConstMetric(c.loaded, prometheus.GaugeValue, 0, membershipLabel(DefaultMembershipName))
+	}
+
+	for name, timestamp := range updated {
+		// A stale membership is still used, but its Secret is missing or
+		// invalid, so it is reported as not loaded.
+		loaded := 1.0
+		if stale[name] {
+			loaded = 0
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.loaded, prometheus.GaugeValue, loaded, membershipLabel(name))
+		ch <- prometheus.MustNewConstMetric(c.age, prometheus.GaugeValue, time.Since(timestamp).Seconds(), membershipLabel(name))
+	}
+}
+
+// DefaultMembershipLabel is the value of the membership label of the
+// default membership. It is not a valid object name, so that it cannot be
+// mistaken for a named membership.
+const DefaultMembershipLabel = "<default>"
+
+// membershipLabel returns the value of the membership label for the
+// membership with the given name.
+func membershipLabel(name string) string {
+	if name == DefaultMembershipName {
+		return DefaultMembershipLabel
+	}
+
+	return name
+}
@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const secretMigrationPageSize = 500
+
+// SecretLabelMigration labels the credentials Secrets created before the
+// operator started labelling them. Only labelled Secrets are cached, so the
+// changes to unlabelled Secrets would otherwise not be watched. It runs once
+// when the operator starts and implements manager.Runnable.
+type SecretLabelMigration struct {
+	Client client.Client
+	// APIReader lists the Secrets, as the unlabelled ones aren't cached.
+	APIReader  client.Reader
+	Logger     logr.Logger
+	Namespaces WatchedNamespaces
+}
+
+func (m *SecretLabelMigration) Start(ctx context.Context) error {
+	namespaces := []string(m.Namespaces)
+	if m.Namespaces.All() {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	migrated := 0
+	for _, namespace := range namespaces {
+		count, err := m.migrateNamespace(ctx, namespace)
+		migrated += count
+		if err != nil {
+			// The reconciler labels the Secrets it syncs, so a failed
+			// migration doesn't prevent the operator from starting.
+			m.Logger.Error(err, "failed to migrate secrets", "namespace", namespace)
+		}
+	}
+
+	m.Logger.Info("Migrated credentials secrets", "count", migrated)
+	return nil
+}
+
+func (m *SecretLabelMigration) migrateNamespace(ctx context.Context, namespace string) (int, error) {
+	migrated := 0
+	options := &client.ListOptions{
+		Namespace: namespace,
+		Limit:     secretMigrationPageSize,
+	}
+
+	for {
+		secrets := &corev1.SecretList{}
+		err := m.APIReader.List(ctx, secrets, options)
+		if err != nil {
+			return migrated, err
+		}
+
+		for i := range secrets.Items {
+			secret := &secrets.Items[i]
+			if secret.Annotations[AnnotationSecretManagedBy] != SecretManagedBy ||
+				secret.Labels[LabelSecretManagedBy] == SecretManagedBy {
+				continue
+			}
+
+			original := secret.DeepCopy()
+			if secret.Labels == nil {
+				secret.Labels = map[string]string{}
+			}
+			secret.Labels[LabelSecretManagedBy] = SecretManagedBy
+
+			err = m.Client.Patch(ctx, secret, client.MergeFrom(original))
+			if k8serrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+
+		if secrets.Continue == "" {
+			return migrated, nil
+		}
+		options.Continue = secrets.Continue
+	}
+}
@@ -0,0 +1,69 @@
+package controllers_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+)
+
+var _ = Describe("Secret Label Migration", func() {
+	var (
+		ctx context.Context
+
+		managedSecret   *corev1.Secret
+		unmanagedSecret *corev1.Secret
+
+		migration *controllers.SecretLabelMigration
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		managedSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "the-managed-secret",
+				Namespace: namespace,
+				Annotations: map[string]string{
+					controllers.AnnotationSecretManagedBy: controllers.SecretManagedBy,
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, managedSecret)).To(Succeed())
+
+		unmanagedSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "the-unmanaged-secret",
+				Namespace: namespace,
+			},
+		}
+		Expect(k8sClient.Create(ctx, unmanagedSecret)).To(Succeed())
+
+		migration = &controllers.SecretLabelMigration{
+			Client:     k8sClient,
+			APIReader:  k8sClient,
+			Logger:     ctrl.Log.WithName("secret-label-migration"),
+			Namespaces: controllers.WatchedNamespaces{namespace},
+		}
+	})
+
+	JustBeforeEach(func() {
+		Expect(migration.Start(ctx)).To(Succeed())
+	})
+
+	It("labels the secrets managed by the operator", func() {
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(managedSecret), managedSecret)).To(Succeed())
+		Expect(managedSecret.Labels).To(HaveKeyWithValue(controllers.LabelSecretManagedBy, controllers.SecretManagedBy))
+	})
+
+	It("does not label other secrets", func() {
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(unmanagedSecret), unmanagedSecret)).To(Succeed())
+		Expect(unmanagedSecret.Labels).NotTo(HaveKey(controllers.LabelSecretManagedBy))
+	})
+})
@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+)
+
+// WatchedNamespaces restricts the operator to a set of namespaces, for
+// namespace-scoped deployments. An empty set means all namespaces.
+type WatchedNamespaces []string
+
+// All reports whether the operator manages all namespaces.
+func (n WatchedNamespaces) All() bool {
+	return len(n) == 0
+}
+
+// Contains reports whether the operator manages the given namespace.
+func (n WatchedNamespaces) Contains(namespace string) bool {
+	if n.All() {
+		return true
+	}
+
+	for _, watched := range n {
+		if watched == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseWatchedNamespaces parses a comma separated list of namespaces. An
+// empty list means all namespaces.
+func ParseWatchedNamespaces(namespaces string) WatchedNamespaces {
+	watched := map[string]bool{}
+	for _, namespace := range strings.Split(namespaces, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if !isEmpty(namespace) {
+			watched[namespace] = true
+		}
+	}
+
+	result := WatchedNamespaces{}
+	for namespace := range watched {
+		result = append(result, namespace)
+	}
+	sort.Strings(result)
+
+	return result
+}
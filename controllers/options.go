@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
+)
+
+const (
+	// AnnotationGCPTokenLifetime sets the lifetime of the impersonated access
+	// tokens, either as a duration ("2h") or as a number of seconds.
+	AnnotationGCPTokenLifetime = "giantswarm.io/gcp-token-lifetime"
+	// AnnotationGCPQuotaProject sets the project used for quota and billing.
+	AnnotationGCPQuotaProject = "giantswarm.io/gcp-quota-project"
+	// AnnotationGCPImpersonation disables the impersonation of the GCP
+	// service account when set to "false". Without a GCP service account,
+	// the federated token is used directly to access GCP resources.
+	AnnotationGCPImpersonation = "giantswarm.io/gcp-impersonation"
+)
+
+// identityAnnotations are the ServiceAccount annotations configuring its
+// workload identity.
+var identityAnnotations = []string{
+	AnnotationGCPServiceAccount,
+	AnnotationGCPTokenLifetime,
+	AnnotationGCPQuotaProject,
+	AnnotationGCPImpersonation,
+}
+
+// IsWorkloadIdentityEnabled reports whether credentials should be generated
+// for a ServiceAccount with the given annotations. That is the case when it
+// references a GCP service account, or when it uses the federated token
+// directly to access GCP resources.
+func IsWorkloadIdentityEnabled(annotations map[string]string) bool {
+	if _, ok := annotations[AnnotationGCPServiceAccount]; ok {
+		return true
+	}
+
+	impersonation, err := strconv.ParseBool(annotations[AnnotationGCPImpersonation])
+	return err == nil && !impersonation
+}
+
+// identityOptions are the options used to render the credential
+// configuration of a workload identity.
+type identityOptions struct {
+	GCPServiceAccount string
+	TokenLifetime     time.Duration
+	QuotaProject      string
+	Impersonation     bool
+}
+
+// identityOptionsFromAnnotations parses the credential options of a
+// ServiceAccount from its annotations.
+func identityOptionsFromAnnotations(annotations map[string]string) (identityOptions, error) {
+	options := identityOptions{
+		GCPServiceAccount: annotations[AnnotationGCPServiceAccount],
+		QuotaProject:      annotations[AnnotationGCPQuotaProject],
+		Impersonation:     true,
+	}
+
+	if value, ok := annotations[AnnotationGCPTokenLifetime]; ok {
+		lifetime, err := parseTokenLifetime(value)
+		if err != nil {
+			return identityOptions{}, fmt.Errorf("invalid %q annotation: %w", AnnotationGCPTokenLifetime, err)
+		}
+		options.TokenLifetime = lifetime
+	}
+
+	if value, ok := annotations[AnnotationGCPImpersonation]; ok {
+		impersonation, err := strconv.ParseBool(value)
+		if err != nil {
+			return identityOptions{}, fmt.Errorf("invalid %q annotation: %w", AnnotationGCPImpersonation, err)
+		}
+		options.Impersonation = impersonation
+	}
+
+	if options.Impersonation && isEmpty(options.GCPServiceAccount) {
+		return identityOptions{}, fmt.Errorf("%q annotation must not be empty", AnnotationGCPServiceAccount)
+	}
+
+	if !options.Impersonation && options.TokenLifetime != 0 {
+		return identityOptions{}, fmt.Errorf("%q annotation requires service account impersonation", AnnotationGCPTokenLifetime)
+	}
+
+	return options, nil
+}
+
+// apply configures the credential configuration builder with the options.
+func (o identityOptions) apply(builder *credentialconfig.Builder) *credentialconfig.Builder {
+	if o.Impersonation {
+		builder = builder.WithServiceAccountImpersonation(o.GCPServiceAccount)
+	}
+
+	return builder.
+		WithTokenLifetime(o.TokenLifetime).
+		WithQuotaProject(o.QuotaProject)
+}
+
+func parseTokenLifetime(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return time.ParseDuration(value)
+}
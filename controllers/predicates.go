@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/api/v1alpha1"
+)
+
+// reconciledAnnotations are the ServiceAccount annotations the credentials
+// are generated from.
+var reconciledAnnotations = append([]string{
+	AnnotationGCPMembership,
+	AnnotationCredentialsSecretName,
+	AnnotationGCPAdditionalServiceAccounts,
+}, identityAnnotations...)
+
+// operatorAnnotations are the ServiceAccount annotations written by the
+// operator. They are only removed once the credentials have been deleted.
+var operatorAnnotations = []string{
+	AnnotationStatus,
+	AnnotationGCPPrincipal,
+}
+
+// ServiceAccountPredicate filters out the events of the ServiceAccounts the
+// operator doesn't manage, like the default ServiceAccount of every
+// Namespace. Updates are only passed when the annotations the credentials are
+// generated from change, including when they are removed, so that the
+// annotations written by the operator don't trigger another reconciliation.
+//
+// When the operator starts, every existing ServiceAccount is passed as a
+// create event. ServiceAccounts whose annotations were removed while the
+// operator was down still carry the annotations written by the operator, so
+// that their credentials are deleted.
+//
+// ServiceAccounts without annotations are also passed when they are created
+// or deleted while a WorkloadIdentityBinding names them. The bindings are
+// looked up with the given reader, which must index them by
+// BindingServiceAccountNameField. They are not looked up when the reader is
+// nil.
+func ServiceAccountPredicate(bindings client.Reader) predicate.Predicate {
+	isManaged := func(obj client.Object) bool {
+		return isManagedServiceAccount(obj) || isBoundServiceAccount(bindings, obj)
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isManaged(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return annotationsChanged(e.ObjectOld, e.ObjectNew, reconciledAnnotations)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return isManaged(e.Object)
+		},
+	}
+}
+
+// isManagedServiceAccount reports whether the ServiceAccount is configured
+// for workload identity, or was configured when last reconciled.
+func isManagedServiceAccount(obj client.Object) bool {
+	annotations := obj.GetAnnotations()
+
+	for _, keys := range [][]string{reconciledAnnotations, operatorAnnotations} {
+		for _, key := range keys {
+			if _, ok := annotations[key]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isBoundServiceAccount reports whether a WorkloadIdentityBinding names the
+// ServiceAccount. ServiceAccounts are passed when the bindings can't be
+// listed, so that they are not missed.
+func isBoundServiceAccount(bindings client.Reader, obj client.Object) bool {
+	if bindings == nil {
+		return false
+	}
+
+	bindingList := &v1alpha1.WorkloadIdentityBindingList{}
+	err := bindings.List(context.Background(), bindingList,
+		client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{BindingServiceAccountNameField: obj.GetName()},
+	)
+	if err != nil {
+		return true
+	}
+
+	return len(bindingList.Items) > 0
+}
+
+func annotationsChanged(oldObj, newObj client.Object, keys []string) bool {
+	if oldObj == nil || newObj == nil {
+		return true
+	}
+
+	oldAnnotations := oldObj.GetAnnotations()
+	newAnnotations := newObj.GetAnnotations()
+
+	for _, key := range keys {
+		oldValue, oldOk := oldAnnotations[key]
+		newValue, newOk := newAnnotations[key]
+		if oldOk != newOk || oldValue != newValue {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,75 @@
+package controllers_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+)
+
+var _ = Describe("Service Account Predicate", func() {
+	var (
+		serviceAccountPredicate predicate.Predicate
+
+		newServiceAccount = func(annotations map[string]string) *corev1.ServiceAccount {
+			return &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "the-service-account",
+					Namespace:   "the-namespace",
+					Annotations: annotations,
+				},
+			}
+		}
+	)
+
+	BeforeEach(func() {
+		serviceAccountPredicate = controllers.ServiceAccountPredicate(nil)
+	})
+
+	It("ignores the creation of service accounts without workload identity", func() {
+		Expect(serviceAccountPredicate.Create(event.CreateEvent{
+			Object: newServiceAccount(nil),
+		})).To(BeFalse())
+	})
+
+	It("passes the creation of annotated service accounts", func() {
+		Expect(serviceAccountPredicate.Create(event.CreateEvent{
+			Object: newServiceAccount(map[string]string{
+				controllers.AnnotationGCPServiceAccount: "service-account@email",
+			}),
+		})).To(BeTrue())
+	})
+
+	It("passes the creation of service accounts previously managed by the operator", func() {
+		Expect(serviceAccountPredicate.Create(event.CreateEvent{
+			Object: newServiceAccount(map[string]string{
+				controllers.AnnotationStatus: "{}",
+			}),
+		})).To(BeTrue())
+	})
+
+	It("passes the removal of the workload identity annotations", func() {
+		Expect(serviceAccountPredicate.Update(event.UpdateEvent{
+			ObjectOld: newServiceAccount(map[string]string{
+				controllers.AnnotationGCPServiceAccount: "service-account@email",
+			}),
+			ObjectNew: newServiceAccount(nil),
+		})).To(BeTrue())
+	})
+
+	It("ignores updates of the annotations written by the operator", func() {
+		Expect(serviceAccountPredicate.Update(event.UpdateEvent{
+			ObjectOld: newServiceAccount(map[string]string{
+				controllers.AnnotationGCPServiceAccount: "service-account@email",
+			}),
+			ObjectNew: newServiceAccount(map[string]string{
+				controllers.AnnotationGCPServiceAccount: "service-account@email",
+				controllers.AnnotationReady:             "True",
+			}),
+		})).To(BeFalse())
+	})
+})
@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"fmt"
+)
+
+const (
+	// AnnotationGCPPrincipal and AnnotationGCPPrincipalSet are set by the
+	// operator to the IAM identifiers of the ServiceAccount in the workload
+	// identity pool. They can be used to grant roles directly to the
+	// ServiceAccount, without a GCP service account.
+	AnnotationGCPPrincipal    = "giantswarm.io/gcp-principal"
+	AnnotationGCPPrincipalSet = "giantswarm.io/gcp-principal-set"
+)
+
+// Principal returns the IAM principal identifier of the given Kubernetes
+// ServiceAccount.
+func Principal(projectNumber, workloadIdentityPool, namespace, serviceAccountName string) string {
+	return fmt.Sprintf("principal://iam.googleapis.com/%s/subject/system:serviceaccount:%s:%s",
+		workloadIdentityPoolResource(projectNumber, workloadIdentityPool), namespace, serviceAccountName)
+}
+
+// PrincipalSet returns the IAM principal set identifier of all the
+// Kubernetes ServiceAccounts of the given namespace. It requires the
+// workload identity pool provider to map the namespace of the token to the
+// `attribute.namespace` attribute.
+func PrincipalSet(projectNumber, workloadIdentityPool, namespace string) string {
+	return fmt.Sprintf("principalSet://iam.googleapis.com/%s/attribute.namespace/%s",
+		workloadIdentityPoolResource(projectNumber, workloadIdentityPool), namespace)
+}
+
+func workloadIdentityPoolResource(projectNumber, workloadIdentityPool string) string {
+	return fmt.Sprintf("projects/%s/locations/global/workloadIdentityPools/%s", projectNumber, workloadIdentityPool)
+}
@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/giantswarm/fleet-membership-operator-gcp/types"
+)
+
+var (
+	projectNumberRegexp = regexp.MustCompile(`^[0-9]+$`)
+	// Pool and provider IDs are 4 to 32 lowercase letters, digits and
+	// hyphens, and don't start or end with a hyphen.
+	workloadIdentityIDRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,30}[a-z0-9]$`)
+)
+
+// reservedWorkloadIdentityIDPrefix is reserved by Google for the pool and
+// provider IDs.
+const reservedWorkloadIdentityIDPrefix = "gcp-"
+
+// Federation describes how the Kubernetes ServiceAccount tokens of a
+// ServiceAccount are exchanged for Google credentials.
+type Federation struct {
+	// WorkloadIdentityPool is the ID of the workload identity pool.
+	WorkloadIdentityPool string
+	// TokenAudience is the audience of the ServiceAccount token projected
+	// into pods.
+	TokenAudience string
+	// CredentialsAudience is the audience of the credential configuration.
+	CredentialsAudience string
+}
+
+// MembershipFederation returns the Federation of a fleet membership, as
+// registered by fleet-membership-operator-gcp.
+func MembershipFederation(membership types.MembershipData) Federation {
+	return Federation{
+		WorkloadIdentityPool: membership.WorkloadIdentityPool,
+		TokenAudience:        membership.WorkloadIdentityPool,
+		CredentialsAudience:  fmt.Sprintf("identitynamespace:%s:%s", membership.WorkloadIdentityPool, membership.IdentityProvider),
+	}
+}
+
+// WorkloadIdentityProvider is a workload identity pool provider configured
+// without a fleet membership, for clusters registered in a plain workload
+// identity federation pool with an OIDC provider.
+type WorkloadIdentityProvider struct {
+	ProjectNumber string
+	PoolID        string
+	ProviderID    string
+}
+
+// Enabled reports whether the provider has been configured.
+func (p WorkloadIdentityProvider) Enabled() bool {
+	return !isEmpty(p.PoolID) || !isEmpty(p.ProviderID)
+}
+
+// Validate checks that the provider identifies a valid workload identity
+// pool provider.
+func (p WorkloadIdentityProvider) Validate() error {
+	if !projectNumberRegexp.MatchString(p.ProjectNumber) {
+		return fmt.Errorf("project number %q is not a valid project number", p.ProjectNumber)
+	}
+
+	err := validateWorkloadIdentityID(p.PoolID)
+	if err != nil {
+		return fmt.Errorf("workload identity pool %q is not a valid pool id: %w", p.PoolID, err)
+	}
+
+	err = validateWorkloadIdentityID(p.ProviderID)
+	if err != nil {
+		return fmt.Errorf("workload identity provider %q is not a valid provider id: %w", p.ProviderID, err)
+	}
+
+	return nil
+}
+
+func validateWorkloadIdentityID(id string) error {
+	if !workloadIdentityIDRegexp.MatchString(id) {
+		return errors.New("it must be 4 to 32 lowercase letters, digits or hyphens, and can't start or end with a hyphen")
+	}
+
+	if strings.HasPrefix(id, reservedWorkloadIdentityIDPrefix) {
+		return fmt.Errorf("the %q prefix is reserved by Google", reservedWorkloadIdentityIDPrefix)
+	}
+
+	return nil
+}
+
+// Audience returns the full resource name of the provider, which is used as
+// the audience of both the projected token and the credentials.
+func (p WorkloadIdentityProvider) Audience() string {
+	return fmt.Sprintf("//iam.googleapis.com/%s/providers/%s",
+		workloadIdentityPoolResource(p.ProjectNumber, p.PoolID), p.ProviderID)
+}
+
+// Federation returns the Federation of the provider.
+func (p WorkloadIdentityProvider) Federation() Federation {
+	return Federation{
+		WorkloadIdentityPool: p.PoolID,
+		TokenAudience:        p.Audience(),
+		CredentialsAudience:  p.Audience(),
+	}
+}
+
+// errStandalone is returned when a membership is requested from a store
+// running in standalone mode.
+var errStandalone = errors.New("memberships are not used in standalone mode")
@@ -0,0 +1,44 @@
+package controllers_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+)
+
+var _ = Describe("Workload Identity Provider", func() {
+	newProvider := func(projectNumber, poolID, providerID string) controllers.WorkloadIdentityProvider {
+		return controllers.WorkloadIdentityProvider{
+			ProjectNumber: projectNumber,
+			PoolID:        poolID,
+			ProviderID:    providerID,
+		}
+	}
+
+	DescribeTable("validates the provider",
+		func(provider controllers.WorkloadIdentityProvider, valid bool) {
+			err := provider.Validate()
+			if valid {
+				Expect(err).NotTo(HaveOccurred())
+			} else {
+				Expect(err).To(HaveOccurred())
+			}
+		},
+		Entry("valid provider", newProvider("123456789", "the-pool", "the-provider"), true),
+		Entry("shortest ids", newProvider("123456789", "pool", "prov"), true),
+		Entry("longest ids", newProvider("123456789", "a2345678901234567890123456789012", "the-provider"), true),
+		Entry("ids containing gcp", newProvider("123456789", "my-gcp-pool", "gcp1"), true),
+		Entry("missing project number", newProvider("", "the-pool", "the-provider"), false),
+		Entry("project id instead of number", newProvider("the-project", "the-pool", "the-provider"), false),
+		Entry("pool id too short", newProvider("123456789", "poo", "the-provider"), false),
+		Entry("pool id too long", newProvider("123456789", "a23456789012345678901234567890123", "the-provider"), false),
+		Entry("pool id with uppercase letters", newProvider("123456789", "The-Pool", "the-provider"), false),
+		Entry("pool id with a leading hyphen", newProvider("123456789", "-the-pool", "the-provider"), false),
+		Entry("pool id with a trailing hyphen", newProvider("123456789", "the-pool-", "the-provider"), false),
+		Entry("pool id with the reserved prefix", newProvider("123456789", "gcp-pool", "the-provider"), false),
+		Entry("provider id with a leading hyphen", newProvider("123456789", "the-pool", "-the-provider"), false),
+		Entry("provider id with a trailing hyphen", newProvider("123456789", "the-pool", "the-provider-"), false),
+		Entry("provider id with the reserved prefix", newProvider("123456789", "the-pool", "gcp-provider"), false),
+	)
+})
@@ -2,28 +2,48 @@ package controllers
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"strings"
+	"time"
 
-	"github.com/giantswarm/fleet-membership-operator-gcp/types"
 	"github.com/go-logr/logr"
+	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/api/v1alpha1"
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
 )
 
 const (
 	AnnotationSecretMetadata    = "kubernetes.io/service-account.name" //#nosec G101
 	AnnotationSecretManagedBy   = "app.kubernetes.io/managed-by"       //#nosec  G101
+	LabelSecretManagedBy        = "app.kubernetes.io/managed-by"       //#nosec  G101
 	AnnotationGCPServiceAccount = "giantswarm.io/gcp-service-account"
 
+	// AnnotationCredentialsSecretName is set by the operator on
+	// ServiceAccounts whose credentials Secret uses a fallback name.
+	AnnotationCredentialsSecretName = "giantswarm.io/gcp-credentials-secret" //#nosec G101
+
 	SecretManagedBy = "workload-identity-operator-gcp" //#nosec G101
 
 	MembershipSecretName             = "fleet-membership-operator-gcp-membership"
@@ -34,64 +54,194 @@ const (
 
 	ServiceAccountTokenPath         = "token"
 	VolumeMountWorkloadIdentityPath = "/var/run/secrets/workload-identity"
+
+	DefaultMembershipChangeQPS = 10
+
+	DefaultReconcileQPS   = 10
+	DefaultReconcileBurst = 100
+
+	SecretConflictRequeueAfter = 5 * time.Minute
+
+	EventReasonSecretCreated         = "SecretCreated"
+	EventReasonSecretUpdated         = "SecretUpdated"
+	EventReasonSecretDeleted         = "SecretDeleted"
+	EventReasonSecretSyncFailed      = "SecretSyncFailed"
+	EventReasonMembershipUnavailable = "MembershipUnavailable"
 )
 
 type ServiceAccountReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
-	Logger logr.Logger
+	// APIReader reads the Secrets that are not cached, i.e. Secrets that
+	// aren't labelled as managed by the operator. Defaults to the Client.
+	APIReader  client.Reader
+	Scheme     *runtime.Scheme
+	Logger     logr.Logger
+	Recorder   record.EventRecorder
+	Membership *MembershipStore
+
+	// MembershipChangeQPS limits the rate at which annotated ServiceAccounts
+	// are enqueued when the membership changes. Defaults to
+	// DefaultMembershipChangeQPS.
+	MembershipChangeQPS float64
+
+	// MaxConcurrentReconciles is the number of ServiceAccounts reconciled
+	// concurrently. Defaults to 1.
+	MaxConcurrentReconciles int
+
+	// ReconcileQPS and ReconcileBurst limit the overall rate of
+	// reconciliations, on top of the per ServiceAccount exponential backoff.
+	// They default to DefaultReconcileQPS and DefaultReconcileBurst.
+	ReconcileQPS   float64
+	ReconcileBurst int
+
+	// SecretNameFallback enables using a hashed Secret name when the
+	// credentials Secret name is taken by a Secret the operator does not
+	// manage.
+	SecretNameFallback bool
+
+	// ProjectNumber is the number of the project hosting the workload
+	// identity pool. It is used to publish the IAM principal identifiers of
+	// the ServiceAccounts.
+	ProjectNumber string
+
+	// Endpoints are the Google API endpoints used by the generated
+	// credentials. They can be overridden with Namespace annotations.
+	Endpoints Endpoints
+
+	// Namespaces restricts the reconciler to a set of namespaces. Defaults to
+	// all namespaces.
+	Namespaces WatchedNamespaces
+
+	// ClusterName is the name of the workload cluster the ServiceAccounts are
+	// reconciled in, when running in multi-cluster mode. It labels the
+	// metrics. Defaults to LocalClusterName.
+	ClusterName string
+
+	// DisableBindings ignores the WorkloadIdentityBindings, for workload
+	// clusters where their CRD is not installed.
+	DisableBindings bool
 }
 
 //+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=serviceaccounts/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=serviceaccounts/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=workloadidentity.giantswarm.io,resources=workloadidentitybindings,verbs=get;list;watch
+//+kubebuilder:rbac:groups=workloadidentity.giantswarm.io,resources=workloadidentitybindings/status,verbs=get;update;patch
 
 func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := r.Logger.WithValues("service-account", req.NamespacedName)
 
+	if !r.Namespaces.Contains(req.Namespace) {
+		return reconcile.Result{}, nil
+	}
+
+	bindings, err := r.listBindings(ctx, req.NamespacedName)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
 	serviceAccount := &corev1.ServiceAccount{}
 
-	err := r.Get(ctx, req.NamespacedName, serviceAccount)
+	err = r.Get(ctx, req.NamespacedName, serviceAccount)
 	if err != nil {
 		logger.Error(err, "could not get service account")
+		if k8serrors.IsNotFound(err) {
+			managedServiceAccounts.remove(r.clusterName(), req.NamespacedName)
+			return reconcile.Result{}, r.updateBindingStatuses(ctx, nil, bindings, nil)
+		}
 		return reconcile.Result{}, nil
 	}
 
-	gcpServiceAccount, isGCPAnnotated := serviceAccount.Annotations[AnnotationGCPServiceAccount]
+	annotations, activeBinding := effectiveAnnotations(serviceAccount, bindings)
 
-	if !isGCPAnnotated {
-		message := fmt.Sprintf("Skipping ServiceAccount missing %q annotation", AnnotationGCPServiceAccount)
+	result, err := r.reconcileServiceAccount(ctx, serviceAccount, annotations)
+
+	statusErr := r.updateBindingStatuses(ctx, serviceAccount, bindings, activeBinding)
+	if err == nil {
+		err = statusErr
+	}
+
+	return result, err
+}
+
+// reconcileServiceAccount generates the credentials of the ServiceAccount
+// from the given workload identity annotations.
+func (r *ServiceAccountReconciler) reconcileServiceAccount(ctx context.Context, serviceAccount *corev1.ServiceAccount, annotations map[string]string) (ctrl.Result, error) {
+	key := client.ObjectKeyFromObject(serviceAccount)
+	logger := r.Logger.WithValues("service-account", key)
+
+	if !IsWorkloadIdentityEnabled(annotations) {
+		message := fmt.Sprintf("Skipping ServiceAccount without %q annotation or binding", AnnotationGCPServiceAccount)
 		logger.Info(message)
+		managedServiceAccounts.remove(r.clusterName(), key)
+
+		err := r.deleteManagedSecret(ctx, serviceAccount)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		err = r.deleteIdentitySecrets(ctx, serviceAccount, nil)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		err = r.updateAnnotations(ctx, serviceAccount, func(annotations map[string]string) {
+			delete(annotations, AnnotationGCPPrincipal)
+			delete(annotations, AnnotationGCPPrincipalSet)
+		})
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		err = r.clearStatus(ctx, serviceAccount)
 		return reconcile.Result{}, err
 	}
 
-	membership, err := GetMembershipFromSecret(ctx, r.Client, logger)
+	membershipName, err := ResolveMembershipName(ctx, r.Client, serviceAccount.Namespace, annotations)
 	if err != nil {
-		logger.Error(err, "failed to get membership from secret")
+		logger.Error(err, "failed to resolve membership")
 		return reconcile.Result{}, err
 	}
 
-	identityProvider := membership.IdentityProvider
-	workloadIdentityPool := membership.WorkloadIdentityPool
+	observedConfiguration := ObservedConfiguration(annotations, membershipName)
+
+	federation, err := r.Membership.Federation(ctx, membershipName)
+	if err != nil {
+		logger.Error(err, "failed to get membership")
+		r.Recorder.Eventf(serviceAccount, corev1.EventTypeWarning, EventReasonMembershipUnavailable,
+			"Cannot generate credentials, the fleet membership is not available: %s", err)
+		membershipErrorsTotal.WithLabelValues(r.clusterName()).Inc()
+		managedServiceAccounts.set(r.clusterName(), key, false)
+
+		statusErr := r.setConditions(ctx, serviceAccount, observedConfiguration,
+			conditionFalse(ConditionMembershipAvailable, ReasonMembershipUnavailable, err.Error()),
+		)
+		if statusErr != nil {
+			logger.Error(statusErr, "failed to update status")
+		}
 
-	if isEmpty(identityProvider) {
-		err = fmt.Errorf("membership does not have an identity provider %+v", membership)
-		logger.Error(err, "membership not configured properly")
 		return reconcile.Result{}, err
 	}
 
-	if isEmpty(workloadIdentityPool) {
-		err = fmt.Errorf("membership does not have a workload identity pool %+v", membership)
-		logger.Error(err, "membership not configured properly")
+	workloadIdentityPool := federation.WorkloadIdentityPool
+
+	err = r.setConditions(ctx, serviceAccount, observedConfiguration,
+		conditionTrue(ConditionMembershipAvailable, ReasonMembershipAvailable,
+			fmt.Sprintf("Using workload identity pool %q", workloadIdentityPool)),
+	)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	secretName := fmt.Sprintf("%s-%s", serviceAccount.Name, SecretNameSuffix)
+	secretName := CredentialsSecretName(serviceAccount)
 	secret := &corev1.Secret{}
 
-	err = r.Get(ctx, k8stypes.NamespacedName{
+	err = r.getSecret(ctx, k8stypes.NamespacedName{
 		Name:      secretName,
-		Namespace: req.Namespace,
+		Namespace: serviceAccount.Namespace,
 	}, secret)
 
 	if err != nil && !k8serrors.IsNotFound(err) {
@@ -99,87 +249,342 @@ func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return reconcile.Result{}, err
 	}
 
-	data := fmt.Sprintf(`{
-	     "type": "external_account",
-	     "audience": "identitynamespace:%[1]s:%[2]s",
-	     "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%[3]s:generateAccessToken",
-	     "subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
-	     "token_url": "https://sts.googleapis.com/v1/token",
-	     "credential_source": {
-	       "file": "%[4]s/%[5]s"
-	     }
-	   }`,
-		workloadIdentityPool, identityProvider, gcpServiceAccount,
-		VolumeMountWorkloadIdentityPath,
-		ServiceAccountTokenPath)
+	if !secret.CreationTimestamp.IsZero() && !isManagedSecret(secret, serviceAccount) {
+		return r.handleSecretConflict(ctx, serviceAccount, secretName, observedConfiguration)
+	}
+
+	err = r.publishPrincipals(ctx, serviceAccount, workloadIdentityPool)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	options, err := identityOptionsFromAnnotations(annotations)
+	if err != nil {
+		return r.handleInvalidConfiguration(ctx, serviceAccount, err, observedConfiguration)
+	}
 
-	newSecret, err := r.generateNewSecret(serviceAccount, secretName, data)
+	identities, err := AdditionalServiceAccounts(annotations)
+	if err != nil {
+		return r.handleInvalidConfiguration(ctx, serviceAccount, err, observedConfiguration)
+	}
+
+	endpoints, err := r.namespaceEndpoints(ctx, serviceAccount.Namespace)
 	if err != nil {
-		logger.Error(err, "failed to generate new secret")
+		return reconcile.Result{}, err
+	}
+
+	configBuilder := credentialconfig.NewBuilder(
+		federation.CredentialsAudience,
+		fmt.Sprintf("%s/%s", VolumeMountWorkloadIdentityPath, ServiceAccountTokenPath),
+	)
+
+	config, err := options.apply(endpoints.apply(configBuilder)).Build()
+	if err != nil {
+		return r.handleInvalidConfiguration(ctx, serviceAccount, err, observedConfiguration)
+	}
+
+	data, err := config.Marshal()
+	if err != nil {
+		logger.Error(err, "failed to marshal credential configuration")
 		return reconcile.Result{}, err
 	}
 
 	if !secret.CreationTimestamp.IsZero() {
-		err = r.updateSecret(ctx, newSecret)
+		updatedSecret, err := r.syncSecret(serviceAccount, secret, data)
+		if err != nil {
+			logger.Error(err, "failed to sync secret")
+			return reconcile.Result{}, err
+		}
+
+		if !equality.Semantic.DeepEqual(secret, updatedSecret) {
+			logger.Info("Secret is out of date, updating")
+			err = r.updateSecret(ctx, serviceAccount, updatedSecret)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	} else {
+		newSecret, err := r.generateNewSecret(serviceAccount, secretName, data)
+		if err != nil {
+			logger.Error(err, "failed to generate new secret")
+			return reconcile.Result{}, err
+		}
+
+		err = r.createSecret(ctx, serviceAccount, newSecret)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	err = r.syncIdentitySecrets(ctx, serviceAccount, secretName, config, endpoints, identities)
+	if err != nil {
+		logger.Error(err, "failed to sync container identity secrets")
+		managedServiceAccounts.set(r.clusterName(), key, false)
 		return reconcile.Result{}, err
 	}
 
-	err = r.createSecret(ctx, newSecret)
+	managedServiceAccounts.set(r.clusterName(), key, true)
+
+	err = r.setConditions(ctx, serviceAccount, observedConfiguration,
+		conditionTrue(ConditionPolicyAllowed, ReasonPolicyAllowed, "The workload identity configuration is allowed"),
+		conditionTrue(ConditionSecretSynced, ReasonSecretSynced, fmt.Sprintf("Credentials are stored in secret %q", secretName)),
+	)
 
 	return ctrl.Result{}, err
 }
 
-func GetMembershipFromSecret(ctx context.Context, c client.Client, logger logr.Logger) (types.MembershipData, error) {
-	secret := &corev1.Secret{}
+// handleInvalidConfiguration reports credential configurations that can't
+// be rendered. They are not retried, as only a change of the ServiceAccount
+// can fix them.
+func (r *ServiceAccountReconciler) handleInvalidConfiguration(ctx context.Context, serviceAccount *corev1.ServiceAccount, configErr error, observedConfiguration string) (reconcile.Result, error) {
+	logger := r.Logger.WithValues("service-account", client.ObjectKeyFromObject(serviceAccount))
 
-	err := c.Get(ctx, client.ObjectKey{
-		Namespace: DefaultMembershipSecretNamespace,
-		Name:      MembershipSecretName,
-	}, secret)
+	logger.Error(configErr, "invalid credential configuration")
+	r.Recorder.Event(serviceAccount, corev1.EventTypeWarning, ReasonInvalidConfiguration, configErr.Error())
+	managedServiceAccounts.set(r.clusterName(), client.ObjectKeyFromObject(serviceAccount), false)
+
+	err := r.setConditions(ctx, serviceAccount, observedConfiguration,
+		conditionFalse(ConditionPolicyAllowed, ReasonInvalidConfiguration, configErr.Error()),
+		conditionFalse(ConditionSecretSynced, ReasonInvalidConfiguration, configErr.Error()),
+	)
+
+	return reconcile.Result{}, err
+}
+
+// handleSecretConflict is called when the credentials Secret name is taken by
+// a Secret the operator does not manage. The Secret is left untouched and, if
+// enabled, the ServiceAccount is switched to a fallback Secret name.
+func (r *ServiceAccountReconciler) handleSecretConflict(ctx context.Context, serviceAccount *corev1.ServiceAccount, secretName, observedConfiguration string) (reconcile.Result, error) {
+	logger := r.Logger.WithValues("service-account", client.ObjectKeyFromObject(serviceAccount))
+
+	message := fmt.Sprintf("Secret %q already exists and is not managed by %s", secretName, SecretManagedBy)
+	logger.Info(message)
+	r.Recorder.Event(serviceAccount, corev1.EventTypeWarning, ReasonSecretConflict, message)
+	managedServiceAccounts.set(r.clusterName(), client.ObjectKeyFromObject(serviceAccount), false)
+
+	fallbackName := fallbackCredentialsSecretName(serviceAccount)
+	if r.SecretNameFallback && secretName != fallbackName {
+		err := r.updateAnnotations(ctx, serviceAccount, func(annotations map[string]string) {
+			annotations[AnnotationCredentialsSecretName] = fallbackName
+		})
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		logger.Info("Using fallback secret name", "secret", fallbackName)
+		return reconcile.Result{Requeue: true}, nil
+	}
+
+	err := r.setConditions(ctx, serviceAccount, observedConfiguration,
+		conditionFalse(ConditionSecretSynced, ReasonSecretConflict, message),
+	)
+
+	// Secrets that aren't managed by the operator are not watched, so the
+	// conflict is checked again periodically.
+	return reconcile.Result{RequeueAfter: SecretConflictRequeueAfter}, err
+}
+
+// publishPrincipals sets the IAM identifiers of the ServiceAccount in its
+// annotations. They can only be computed when the project number of the
+// workload identity pool is known.
+func (r *ServiceAccountReconciler) publishPrincipals(ctx context.Context, serviceAccount *corev1.ServiceAccount, workloadIdentityPool string) error {
+	if isEmpty(r.ProjectNumber) {
+		return nil
+	}
+
+	return r.updateAnnotations(ctx, serviceAccount, func(annotations map[string]string) {
+		annotations[AnnotationGCPPrincipal] = Principal(r.ProjectNumber, workloadIdentityPool, serviceAccount.Namespace, serviceAccount.Name)
+		annotations[AnnotationGCPPrincipalSet] = PrincipalSet(r.ProjectNumber, workloadIdentityPool, serviceAccount.Namespace)
+	})
+}
+
+// namespaceEndpoints returns the Endpoints used for the ServiceAccounts of
+// the given Namespace.
+func (r *ServiceAccountReconciler) namespaceEndpoints(ctx context.Context, name string) (Endpoints, error) {
+	namespace := &corev1.Namespace{}
+
+	err := r.Get(ctx, client.ObjectKey{Name: name}, namespace)
 	if err != nil {
-		logger.Error(err, "failed to get membership secret")
-		return types.MembershipData{}, err
+		r.Logger.Error(err, "failed to get namespace", "namespace", name)
+		return Endpoints{}, err
 	}
 
-	data := secret.Data[SecretKeyGoogleApplicationCredentials]
+	return r.Endpoints.WithNamespaceOverrides(namespace.Annotations), nil
+}
 
-	membership := types.MembershipData{}
-	err = json.Unmarshal(data, &membership)
+// getSecret gets the Secret with the given key. Only the Secrets labelled as
+// managed by the operator are cached, so Secrets that are not found in the
+// cache are read from the API server. They are either Secrets the operator
+// doesn't manage, which must be detected as conflicts, or Secrets created
+// before the label was introduced, which are labelled when synced.
+func (r *ServiceAccountReconciler) getSecret(ctx context.Context, key client.ObjectKey, secret *corev1.Secret) error {
+	err := r.Get(ctx, key, secret)
+	if !k8serrors.IsNotFound(err) || r.APIReader == nil {
+		return err
+	}
+
+	return r.APIReader.Get(ctx, key, secret)
+}
+
+func (r *ServiceAccountReconciler) clusterName() string {
+	if isEmpty(r.ClusterName) {
+		return LocalClusterName
+	}
 
-	return membership, err
+	return r.ClusterName
 }
 
-func (r *ServiceAccountReconciler) updateSecret(ctx context.Context, secret *corev1.Secret) error {
+// updateAnnotations applies the given mutation to the annotations of the
+// ServiceAccount and patches it if they have changed.
+func (r *ServiceAccountReconciler) updateAnnotations(ctx context.Context, serviceAccount *corev1.ServiceAccount, mutate func(annotations map[string]string)) error {
+	original := serviceAccount.DeepCopy()
+
+	if serviceAccount.Annotations == nil {
+		serviceAccount.Annotations = map[string]string{}
+	}
+	mutate(serviceAccount.Annotations)
+
+	if equality.Semantic.DeepEqual(original.Annotations, serviceAccount.Annotations) {
+		return nil
+	}
+
+	err := r.Patch(ctx, serviceAccount, client.MergeFrom(original))
+	if err != nil {
+		r.Logger.Error(err, "failed to update service account annotations")
+		return err
+	}
+
+	return nil
+}
+
+// DefaultCredentialsSecretName returns the name of the credentials Secret of
+// the ServiceAccount with the given name.
+func DefaultCredentialsSecretName(serviceAccountName string) string {
+	return fmt.Sprintf("%s-%s", serviceAccountName, SecretNameSuffix)
+}
+
+// CredentialsSecretName returns the name of the credentials Secret of the
+// given ServiceAccount, taking into account the fallback name the operator
+// may have chosen.
+func CredentialsSecretName(serviceAccount *corev1.ServiceAccount) string {
+	name, ok := serviceAccount.Annotations[AnnotationCredentialsSecretName]
+	if ok && !isEmpty(name) {
+		return name
+	}
+
+	return DefaultCredentialsSecretName(serviceAccount.Name)
+}
+
+func fallbackCredentialsSecretName(serviceAccount *corev1.ServiceAccount) string {
+	hash := sha256.Sum256([]byte(serviceAccount.UID))
+	return fmt.Sprintf("%s-%s", DefaultCredentialsSecretName(serviceAccount.Name), hex.EncodeToString(hash[:])[:10])
+}
+
+// isManagedSecret reports whether the Secret has been created by the
+// operator for the given ServiceAccount.
+func isManagedSecret(secret *corev1.Secret, serviceAccount *corev1.ServiceAccount) bool {
+	if secret.Annotations[AnnotationSecretManagedBy] != SecretManagedBy {
+		return false
+	}
+
+	for _, ownerReference := range secret.OwnerReferences {
+		if ownerReference.UID == serviceAccount.UID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *ServiceAccountReconciler) updateSecret(ctx context.Context, serviceAccount *corev1.ServiceAccount, secret *corev1.Secret) error {
 	err := r.Update(ctx, secret)
 	if err != nil {
 		r.Logger.Error(err, "failed to update google application credentials json secret")
+		r.Recorder.Eventf(serviceAccount, corev1.EventTypeWarning, EventReasonSecretSyncFailed,
+			"Failed to update credentials secret %q: %s", secret.Name, err)
 		return err
 	}
 
+	secretOperationsTotal.WithLabelValues(r.clusterName(), SecretOperationUpdated).Inc()
+	r.Recorder.Eventf(serviceAccount, corev1.EventTypeNormal, EventReasonSecretUpdated,
+		"Updated credentials secret %q", secret.Name)
+
 	return nil
 }
 
-func (r *ServiceAccountReconciler) createSecret(ctx context.Context, secret *corev1.Secret) error {
+func (r *ServiceAccountReconciler) createSecret(ctx context.Context, serviceAccount *corev1.ServiceAccount, secret *corev1.Secret) error {
 	err := r.Create(ctx, secret)
 	if err != nil {
 		r.Logger.Error(err, "failed to create google application credentials json secret")
+		r.Recorder.Eventf(serviceAccount, corev1.EventTypeWarning, EventReasonSecretSyncFailed,
+			"Failed to create credentials secret %q: %s", secret.Name, err)
+		return err
+	}
+
+	secretOperationsTotal.WithLabelValues(r.clusterName(), SecretOperationCreated).Inc()
+	r.Recorder.Eventf(serviceAccount, corev1.EventTypeNormal, EventReasonSecretCreated,
+		"Created credentials secret %q", secret.Name)
+
+	return nil
+}
+
+// deleteManagedSecret deletes the credentials Secret of a ServiceAccount
+// that is no longer annotated. Secrets that were not created by the operator
+// are never deleted.
+func (r *ServiceAccountReconciler) deleteManagedSecret(ctx context.Context, serviceAccount *corev1.ServiceAccount) error {
+	logger := r.Logger.WithValues("service-account", client.ObjectKeyFromObject(serviceAccount))
+
+	secret := &corev1.Secret{}
+	err := r.getSecret(ctx, k8stypes.NamespacedName{
+		Name:      CredentialsSecretName(serviceAccount),
+		Namespace: serviceAccount.Namespace,
+	}, secret)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "failed to get secret")
 		return err
 	}
 
+	if !isManagedSecret(secret, serviceAccount) {
+		logger.Info("Skipping deletion of secret not managed by the operator", "secret", secret.Name)
+		return nil
+	}
+
+	err = r.Delete(ctx, secret, client.Preconditions{UID: &secret.UID})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "failed to delete google application credentials json secret")
+		r.Recorder.Eventf(serviceAccount, corev1.EventTypeWarning, EventReasonSecretSyncFailed,
+			"Failed to delete credentials secret %q: %s", secret.Name, err)
+		return err
+	}
+
+	secretOperationsTotal.WithLabelValues(r.clusterName(), SecretOperationDeleted).Inc()
+	r.Recorder.Eventf(serviceAccount, corev1.EventTypeNormal, EventReasonSecretDeleted,
+		"Deleted credentials secret %q", secret.Name)
+
+	logger.Info("Deleted google application credentials json secret", "secret", secret.Name)
 	return nil
 }
 
-func (r *ServiceAccountReconciler) generateNewSecret(serviceAccount *corev1.ServiceAccount, name, data string) (*corev1.Secret, error) {
+func (r *ServiceAccountReconciler) generateNewSecret(serviceAccount *corev1.ServiceAccount, name string, data []byte) (*corev1.Secret, error) {
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: serviceAccount.Namespace,
+			Labels: map[string]string{
+				LabelSecretManagedBy: SecretManagedBy,
+			},
 			Annotations: map[string]string{
 				AnnotationSecretMetadata:  serviceAccount.Name,
 				AnnotationSecretManagedBy: SecretManagedBy,
 			},
 		},
-		StringData: map[string]string{
+		Data: map[string][]byte{
 			SecretKeyGoogleApplicationCredentials: data,
 		},
 		Type: corev1.SecretTypeServiceAccountToken,
@@ -194,13 +599,215 @@ func (r *ServiceAccountReconciler) generateNewSecret(serviceAccount *corev1.Serv
 	return secret, nil
 }
 
+// syncSecret returns a copy of the existing Secret with the fields managed by
+// the operator set to their expected values. Other data and annotations are
+// left untouched, as the token controller maintains its own keys on Secrets
+// of type service-account-token.
+func (r *ServiceAccountReconciler) syncSecret(serviceAccount *corev1.ServiceAccount, existing *corev1.Secret, data []byte) (*corev1.Secret, error) {
+	secret := existing.DeepCopy()
+
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	secret.Labels[LabelSecretManagedBy] = SecretManagedBy
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[AnnotationSecretMetadata] = serviceAccount.Name
+	secret.Annotations[AnnotationSecretManagedBy] = SecretManagedBy
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[SecretKeyGoogleApplicationCredentials] = data
+
+	err := controllerutil.SetOwnerReference(serviceAccount, secret, r.Scheme)
+	if err != nil {
+		r.Logger.Error(err, "failed to set owner reference on secret")
+		return &corev1.Secret{}, err
+	}
+
+	return secret, nil
+}
+
 func isEmpty(str string) bool {
 	return len(strings.TrimSpace(str)) < 1
 }
 
+// enqueueAnnotatedServiceAccounts enqueues every managed ServiceAccount so
+// that their credentials are regenerated with the new membership. The
+// requests are spread over time to avoid flooding the API server on clusters
+// with many ServiceAccounts.
+func (r *ServiceAccountReconciler) enqueueAnnotatedServiceAccounts(_ event.GenericEvent, queue workqueue.RateLimitingInterface) {
+	keys, err := r.listManagedServiceAccounts(context.Background())
+	if err != nil {
+		r.Logger.Error(err, "failed to list service accounts after membership change")
+		return
+	}
+
+	qps := r.MembershipChangeQPS
+	if qps <= 0 {
+		qps = DefaultMembershipChangeQPS
+	}
+	interval := time.Duration(float64(time.Second) / qps)
+
+	for i, key := range keys {
+		queue.AddAfter(reconcile.Request{NamespacedName: key}, time.Duration(i)*interval)
+	}
+
+	r.Logger.Info("Membership changed, reconciling service accounts", "count", len(keys))
+}
+
+// enqueueNamespaceServiceAccounts maps a Namespace to its managed
+// ServiceAccounts, so that endpoint overrides are applied when the Namespace
+// annotations change.
+func (r *ServiceAccountReconciler) enqueueNamespaceServiceAccounts(namespace client.Object) []reconcile.Request {
+	keys, err := r.listManagedServiceAccounts(context.Background(), client.InNamespace(namespace.GetName()))
+	if err != nil {
+		r.Logger.Error(err, "failed to list service accounts", "namespace", namespace.GetName())
+		return nil
+	}
+
+	requests := []reconcile.Request{}
+	for _, key := range keys {
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+
+	return requests
+}
+
+// controllerOptions returns the options of the controllers running the
+// reconciler. Every controller gets its own rate limiter.
+func (r *ServiceAccountReconciler) controllerOptions() controller.Options {
+	qps := r.ReconcileQPS
+	if qps <= 0 {
+		qps = DefaultReconcileQPS
+	}
+
+	burst := r.ReconcileBurst
+	if burst <= 0 {
+		burst = DefaultReconcileBurst
+	}
+
+	return controller.Options{
+		MaxConcurrentReconciles: r.MaxConcurrentReconciles,
+		RateLimiter: workqueue.NewMaxOfRateLimiter(
+			workqueue.NewItemExponentialFailureRateLimiter(5*time.Millisecond, 1000*time.Second),
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(qps), burst)},
+		),
+	}
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *ServiceAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.ServiceAccount{}).
-		Complete(r)
+	bindings, err := r.bindingsReader(context.Background(), mgr)
+	if err != nil {
+		return err
+	}
+
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(r.controllerOptions()).
+		For(&corev1.ServiceAccount{}, builder.WithPredicates(ServiceAccountPredicate(bindings))).
+		// The credentials Secrets only carry a non-controller owner
+		// reference to their ServiceAccount. They are watched so that edits
+		// and deletions are reverted.
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestForOwner{
+			OwnerType:    &corev1.ServiceAccount{},
+			IsController: false,
+		}).
+		Watches(&source.Channel{Source: r.Membership.Changes()}, handler.Funcs{
+			GenericFunc: r.enqueueAnnotatedServiceAccounts,
+		}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.enqueueNamespaceServiceAccounts),
+			builder.WithPredicates(predicate.AnnotationChangedPredicate{}),
+		)
+
+	// The source of a missing CRD never syncs, which would stop the
+	// manager.
+	if !r.DisableBindings {
+		controllerBuilder = controllerBuilder.Watches(&source.Kind{Type: &v1alpha1.WorkloadIdentityBinding{}},
+			handler.EnqueueRequestsFromMapFunc(enqueueBindingServiceAccount),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		)
+	}
+
+	return controllerBuilder.Complete(r)
+}
+
+// bindingsReader indexes the WorkloadIdentityBindings of the given cluster
+// and returns the cache they are read from by the ServiceAccountPredicate.
+// It returns nil when the bindings are disabled.
+func (r *ServiceAccountReconciler) bindingsReader(ctx context.Context, c cluster.Cluster) (client.Reader, error) {
+	if r.DisableBindings {
+		return nil, nil
+	}
+
+	err := IndexBindings(ctx, c.GetFieldIndexer())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.GetCache(), nil
+}
+
+// watchCluster sets up the watches of a controller reconciling the
+// ServiceAccounts of a remote workload cluster. They mirror the watches set
+// up by SetupWithManager, using the cache of the workload cluster.
+func (r *ServiceAccountReconciler) watchCluster(ctx context.Context, c controller.Controller, workloadCluster cluster.Cluster) error {
+	bindings, err := r.bindingsReader(ctx, workloadCluster)
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(source.NewKindWithCache(&corev1.ServiceAccount{}, workloadCluster.GetCache()),
+		&handler.EnqueueRequestForObject{},
+		ServiceAccountPredicate(bindings),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(source.NewKindWithCache(&corev1.Secret{}, workloadCluster.GetCache()), &handler.EnqueueRequestForOwner{
+		OwnerType:    &corev1.ServiceAccount{},
+		IsController: false,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The stop channel is injected before the controller injects the one of
+	// the manager, so that the source stops with the workload cluster.
+	membershipChanges := &source.Channel{Source: r.Membership.Changes()}
+	err = membershipChanges.InjectStopChannel(ctx.Done())
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(membershipChanges, handler.Funcs{
+		GenericFunc: r.enqueueAnnotatedServiceAccounts,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(source.NewKindWithCache(&corev1.Namespace{}, workloadCluster.GetCache()),
+		handler.EnqueueRequestsFromMapFunc(r.enqueueNamespaceServiceAccounts),
+		predicate.AnnotationChangedPredicate{},
+	)
+	if err != nil {
+		return err
+	}
+
+	// The source of a missing CRD never syncs, which would stop the
+	// controller.
+	if r.DisableBindings {
+		return nil
+	}
+
+	return c.Watch(source.NewKindWithCache(&v1alpha1.WorkloadIdentityBinding{}, workloadCluster.GetCache()),
+		handler.EnqueueRequestsFromMapFunc(enqueueBindingServiceAccount),
+		predicate.GenerationChangedPredicate{},
+	)
 }
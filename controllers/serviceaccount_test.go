@@ -2,19 +2,23 @@ package controllers_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
 	"github.com/giantswarm/workload-identity-operator-gcp/tests"
 )
 
@@ -34,6 +38,7 @@ var _ = Describe("Service Account Reconcilation", func() {
 		serviceAccount *corev1.ServiceAccount
 
 		reconciler *controllers.ServiceAccountReconciler
+		recorder   *record.FakeRecorder
 
 		result      reconcile.Result
 		reconcilErr error
@@ -66,10 +71,13 @@ var _ = Describe("Service Account Reconcilation", func() {
 			identityProvider = "https://test.default.local"
 			tests.EnsureMembershipSecretExists(k8sClient, workloadIdentityPool, identityProvider)
 
+			recorder = record.NewFakeRecorder(100)
 			reconciler = &controllers.ServiceAccountReconciler{
-				Client: k8sClient,
-				Logger: ctrl.Log.WithName("service-account-reconciler"),
-				Scheme: scheme,
+				Client:     k8sClient,
+				Logger:     ctrl.Log.WithName("service-account-reconciler"),
+				Scheme:     scheme,
+				Recorder:   recorder,
+				Membership: controllers.NewMembershipStore(k8sClient, nil, ctrl.Log.WithName("membership-store")),
 			}
 		})
 
@@ -129,6 +137,651 @@ var _ = Describe("Service Account Reconcilation", func() {
 			Expect(data).Should(MatchJSON(expectedData))
 		})
 
+		It("labels the secret as managed by the operator", func() {
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, secret)).To(Succeed())
+			Expect(secret.Labels).To(HaveKeyWithValue(controllers.LabelSecretManagedBy, controllers.SecretManagedBy))
+		})
+
+		When("the secret was created before it was labelled", func() {
+			BeforeEach(func() {
+				secret := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      secretName,
+						Namespace: namespace,
+						Annotations: map[string]string{
+							controllers.AnnotationSecretManagedBy: controllers.SecretManagedBy,
+						},
+						OwnerReferences: []metav1.OwnerReference{
+							{
+								APIVersion: "v1",
+								Kind:       "ServiceAccount",
+								Name:       serviceAccount.Name,
+								UID:        serviceAccount.UID,
+							},
+						},
+					},
+				}
+				Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			})
+
+			It("labels the secret", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				secret := &corev1.Secret{}
+				Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, secret)).To(Succeed())
+				Expect(secret.Labels).To(HaveKeyWithValue(controllers.LabelSecretManagedBy, controllers.SecretManagedBy))
+			})
+		})
+
+		It("records the creation of the secret", func() {
+			Expect(recorder.Events).To(Receive(HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeNormal, controllers.EventReasonSecretCreated))))
+		})
+
+		It("reports the secret as synced", func() {
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+
+			status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.Conditions).To(ContainElement(SatisfyAll(
+				HaveField("Type", controllers.ConditionSecretSynced),
+				HaveField("Status", metav1.ConditionTrue),
+			)))
+		})
+
+		It("reports the service account as ready", func() {
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+			Expect(serviceAccount.Annotations).To(HaveKeyWithValue(controllers.AnnotationReady, "True"))
+
+			status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.ObservedConfiguration).To(Equal(controllers.ObservedConfiguration(serviceAccount.Annotations, "")))
+			for _, conditionType := range []string{
+				controllers.ConditionReady,
+				controllers.ConditionMembershipAvailable,
+				controllers.ConditionPolicyAllowed,
+				controllers.ConditionSecretSynced,
+			} {
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", conditionType),
+					HaveField("Status", metav1.ConditionTrue),
+				)))
+			}
+		})
+
+		It("reports another observed configuration when the annotations change", func() {
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+			status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+			Expect(err).NotTo(HaveOccurred())
+			observedConfiguration := status.ObservedConfiguration
+
+			serviceAccount.Annotations[controllers.AnnotationGCPQuotaProject] = "the-quota-project"
+			Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(serviceAccount)})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+			status, err = controllers.GetWorkloadIdentityStatus(serviceAccount)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.ObservedConfiguration).NotTo(BeEmpty())
+			Expect(status.ObservedConfiguration).NotTo(Equal(observedConfiguration))
+		})
+
+		When("the membership is not available", func() {
+			BeforeEach(func() {
+				membershipSecret := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      controllers.MembershipSecretName,
+						Namespace: controllers.DefaultMembershipSecretNamespace,
+					},
+				}
+				Expect(k8sClient.Delete(ctx, membershipSecret)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				tests.EnsureMembershipSecretExists(k8sClient, workloadIdentityPool, identityProvider)
+			})
+
+			It("reports the membership as unavailable", func() {
+				Expect(reconcilErr).To(HaveOccurred())
+
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				Expect(serviceAccount.Annotations).To(HaveKeyWithValue(controllers.AnnotationReady, "False"))
+
+				status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", controllers.ConditionMembershipAvailable),
+					HaveField("Status", metav1.ConditionFalse),
+					HaveField("Reason", controllers.ReasonMembershipUnavailable),
+				)))
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", controllers.ConditionReady),
+					HaveField("Status", metav1.ConditionFalse),
+					HaveField("Reason", controllers.ReasonMembershipUnavailable),
+				)))
+			})
+		})
+
+		When("the credential options are annotated", func() {
+			BeforeEach(func() {
+				serviceAccount.Annotations[controllers.AnnotationGCPTokenLifetime] = "2h"
+				serviceAccount.Annotations[controllers.AnnotationGCPQuotaProject] = "billing-project"
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+			})
+
+			It("renders the options in the credentials", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				config := getCredentialConfig(ctx, secretName)
+				Expect(config.ServiceAccountImpersonationURL).To(ContainSubstring(gcpServiceAccount))
+				Expect(config.ServiceAccountImpersonation).NotTo(BeNil())
+				Expect(config.ServiceAccountImpersonation.TokenLifetimeSeconds).To(Equal(int64(7200)))
+				Expect(config.QuotaProjectID).To(Equal("billing-project"))
+			})
+		})
+
+		When("the impersonation is disabled", func() {
+			BeforeEach(func() {
+				serviceAccount.Annotations[controllers.AnnotationGCPImpersonation] = "false"
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+			})
+
+			It("does not impersonate the gcp service account", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				config := getCredentialConfig(ctx, secretName)
+				Expect(config.ServiceAccountImpersonationURL).To(BeEmpty())
+				Expect(config.ServiceAccountImpersonation).To(BeNil())
+			})
+		})
+
+		When("the service account uses direct resource access", func() {
+			BeforeEach(func() {
+				delete(serviceAccount.Annotations, controllers.AnnotationGCPServiceAccount)
+				serviceAccount.Annotations[controllers.AnnotationGCPImpersonation] = "false"
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+
+				reconciler.ProjectNumber = "123456789"
+			})
+
+			It("creates credentials without impersonation", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				config := getCredentialConfig(ctx, secretName)
+				Expect(config.ServiceAccountImpersonationURL).To(BeEmpty())
+			})
+
+			It("publishes the principals of the service account", func() {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				Expect(serviceAccount.Annotations).To(HaveKeyWithValue(
+					controllers.AnnotationGCPPrincipal,
+					fmt.Sprintf("principal://iam.googleapis.com/projects/123456789/locations/global/workloadIdentityPools/%s/subject/system:serviceaccount:%s:%s",
+						workloadIdentityPool, namespace, serviceAccountName),
+				))
+				Expect(serviceAccount.Annotations).To(HaveKeyWithValue(
+					controllers.AnnotationGCPPrincipalSet,
+					fmt.Sprintf("principalSet://iam.googleapis.com/projects/123456789/locations/global/workloadIdentityPools/%s/attribute.namespace/%s",
+						workloadIdentityPool, namespace),
+				))
+			})
+		})
+
+		When("the service account selects a named membership", func() {
+			BeforeEach(func() {
+				tests.EnsureNamedMembershipSecretExists(k8sClient, "other-fleet", "other.svc.id.goog", "https://other.default.local")
+
+				serviceAccount.Annotations[controllers.AnnotationGCPMembership] = "other-fleet"
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				membershipSecret := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      controllers.MembershipSecretNameFor("other-fleet"),
+						Namespace: controllers.DefaultMembershipSecretNamespace,
+					},
+				}
+				Expect(k8sClient.Delete(ctx, membershipSecret)).To(Succeed())
+			})
+
+			It("uses the named membership", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				config := getCredentialConfig(ctx, secretName)
+				Expect(config.Audience).To(Equal("identitynamespace:other.svc.id.goog:https://other.default.local"))
+			})
+		})
+
+		When("the namespace selects a missing named membership", func() {
+			BeforeEach(func() {
+				namespaceObj := &corev1.Namespace{}
+				Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+				namespaceObj.Annotations = map[string]string{
+					controllers.AnnotationGCPMembership: "missing-fleet",
+				}
+				Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				namespaceObj := &corev1.Namespace{}
+				Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+				namespaceObj.Annotations = nil
+				Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+			})
+
+			It("reports the membership as unavailable", func() {
+				Expect(reconcilErr).To(MatchError(controllers.ErrMembershipNotLoaded))
+
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				Expect(serviceAccount.Annotations).To(HaveKeyWithValue(controllers.AnnotationReady, "False"))
+			})
+		})
+
+		When("the namespace is not managed by the operator", func() {
+			BeforeEach(func() {
+				reconciler.Namespaces = controllers.WatchedNamespaces{"other"}
+			})
+
+			It("does not create the secret", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, &corev1.Secret{})
+				Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+			})
+		})
+
+		When("the operator runs in standalone mode", func() {
+			BeforeEach(func() {
+				reconciler.ProjectNumber = "123456789"
+				reconciler.Membership = controllers.NewStandaloneMembershipStore(controllers.WorkloadIdentityProvider{
+					ProjectNumber: "123456789",
+					PoolID:        "the-pool",
+					ProviderID:    "the-provider",
+				}, ctrl.Log.WithName("membership-store"))
+			})
+
+			It("uses the provider as the audience", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				config := getCredentialConfig(ctx, secretName)
+				Expect(config.Audience).To(Equal("//iam.googleapis.com/projects/123456789/locations/global/workloadIdentityPools/the-pool/providers/the-provider"))
+			})
+
+			It("publishes the principals of the pool", func() {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				Expect(serviceAccount.Annotations).To(HaveKeyWithValue(controllers.AnnotationGCPPrincipal, fmt.Sprintf(
+					"principal://iam.googleapis.com/projects/123456789/locations/global/workloadIdentityPools/the-pool/subject/system:serviceaccount:%s:%s",
+					namespace, serviceAccountName)))
+			})
+		})
+
+		When("the endpoints are configured", func() {
+			BeforeEach(func() {
+				reconciler.Endpoints = controllers.Endpoints{
+					UniverseDomain: "example.com",
+				}
+			})
+
+			It("derives the endpoints from the universe domain", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				config := getCredentialConfig(ctx, secretName)
+				Expect(config.UniverseDomain).To(Equal("example.com"))
+				Expect(config.TokenURL).To(Equal("https://sts.example.com/v1/token"))
+				Expect(config.ServiceAccountImpersonationURL).To(HavePrefix("https://iamcredentials.example.com/v1/"))
+			})
+
+			When("the namespace overrides the endpoints", func() {
+				BeforeEach(func() {
+					namespaceObj := &corev1.Namespace{}
+					Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+					namespaceObj.Annotations = map[string]string{
+						controllers.AnnotationGCPTokenURL:               "https://sts-psc.p.googleapis.com/v1/token",
+						controllers.AnnotationGCPIAMCredentialsEndpoint: "https://iamcredentials-psc.p.googleapis.com",
+					}
+					Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+				})
+
+				AfterEach(func() {
+					namespaceObj := &corev1.Namespace{}
+					Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+					namespaceObj.Annotations = nil
+					Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+				})
+
+				It("uses the namespace endpoints", func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+
+					config := getCredentialConfig(ctx, secretName)
+					Expect(config.UniverseDomain).To(Equal("example.com"))
+					Expect(config.TokenURL).To(Equal("https://sts-psc.p.googleapis.com/v1/token"))
+					Expect(config.ServiceAccountImpersonationURL).To(HavePrefix("https://iamcredentials-psc.p.googleapis.com/v1/"))
+				})
+			})
+
+			When("the namespace overrides the endpoints with an invalid url", func() {
+				BeforeEach(func() {
+					namespaceObj := &corev1.Namespace{}
+					Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+					namespaceObj.Annotations = map[string]string{
+						controllers.AnnotationGCPTokenURL: "http://sts.example.com/v1/token",
+					}
+					Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+				})
+
+				AfterEach(func() {
+					namespaceObj := &corev1.Namespace{}
+					Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+					namespaceObj.Annotations = nil
+					Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+				})
+
+				It("reports the invalid configuration", func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+					Eventually(recorder.Events).Should(Receive(ContainSubstring(controllers.ReasonInvalidConfiguration)))
+				})
+			})
+		})
+
+		DescribeTable("invalid credential options",
+			func(annotation, value string) {
+				serviceAccount.Annotations[annotation] = value
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+
+				result, reconcilErr = reconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: client.ObjectKeyFromObject(serviceAccount),
+				})
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", controllers.ConditionSecretSynced),
+					HaveField("Status", metav1.ConditionFalse),
+					HaveField("Reason", controllers.ReasonInvalidConfiguration),
+				)))
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", controllers.ConditionPolicyAllowed),
+					HaveField("Status", metav1.ConditionFalse),
+				)))
+				Expect(serviceAccount.Annotations).To(HaveKeyWithValue(controllers.AnnotationReady, "False"))
+			},
+			Entry("unparsable token lifetime", controllers.AnnotationGCPTokenLifetime, "forever"),
+			Entry("token lifetime out of range", controllers.AnnotationGCPTokenLifetime, "24h"),
+			Entry("invalid quota project", controllers.AnnotationGCPQuotaProject, "Not_A_Project"),
+			Entry("unparsable impersonation", controllers.AnnotationGCPImpersonation, "maybe"),
+		)
+
+		When("the service account lists additional gcp service accounts", func() {
+			const uploaderServiceAccount = "uploader@testing-1234.iam.gserviceaccount.com"
+
+			var identitySecretName string
+
+			BeforeEach(func() {
+				identitySecretName = controllers.IdentitySecretName(secretName, uploaderServiceAccount)
+
+				serviceAccount.Annotations[controllers.AnnotationGCPAdditionalServiceAccounts] = uploaderServiceAccount
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+			})
+
+			It("creates a secret impersonating the additional gcp service account", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				config := getCredentialConfig(ctx, identitySecretName)
+				Expect(config.Audience).To(Equal(getCredentialConfig(ctx, secretName).Audience))
+				Expect(config.ServiceAccountImpersonationURL).To(Equal(
+					"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + uploaderServiceAccount + ":generateAccessToken",
+				))
+			})
+
+			It("labels the secret as managed by the operator", func() {
+				secret := &corev1.Secret{}
+				Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: identitySecretName}, secret)).To(Succeed())
+				Expect(secret.Labels).To(HaveKeyWithValue(controllers.LabelSecretManagedBy, controllers.SecretManagedBy))
+				Expect(secret.Annotations).To(HaveKeyWithValue(controllers.AnnotationSecretIdentity, uploaderServiceAccount))
+				Expect(secret.OwnerReferences).Should(ContainElement(HaveField("Name", serviceAccountName)))
+			})
+
+			When("the additional gcp service account is removed", func() {
+				JustBeforeEach(func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+
+					Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+					delete(serviceAccount.Annotations, controllers.AnnotationGCPAdditionalServiceAccounts)
+					Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+
+					result, reconcilErr = reconciler.Reconcile(ctx, reconcile.Request{
+						NamespacedName: client.ObjectKeyFromObject(serviceAccount),
+					})
+				})
+
+				It("deletes its secret", func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+
+					err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: identitySecretName}, &corev1.Secret{})
+					Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+				})
+
+				It("keeps the secret of the service account", func() {
+					Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, &corev1.Secret{})).To(Succeed())
+				})
+			})
+
+			When("the service account uses direct resource access", func() {
+				BeforeEach(func() {
+					delete(serviceAccount.Annotations, controllers.AnnotationGCPServiceAccount)
+					serviceAccount.Annotations[controllers.AnnotationGCPImpersonation] = "false"
+					Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+
+					reconciler.Endpoints = controllers.Endpoints{
+						IAMCredentialsEndpoint: "https://iamcredentials-psc.p.example.com",
+					}
+				})
+
+				It("impersonates through the configured endpoint", func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+
+					config := getCredentialConfig(ctx, identitySecretName)
+					Expect(config.ServiceAccountImpersonationURL).To(HavePrefix("https://iamcredentials-psc.p.example.com/v1/projects/-/serviceAccounts/" + uploaderServiceAccount))
+				})
+			})
+
+			When("the additional gcp service accounts are invalid", func() {
+				BeforeEach(func() {
+					serviceAccount.Annotations[controllers.AnnotationGCPAdditionalServiceAccounts] = "not-an-email"
+					Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+				})
+
+				It("does not create the secrets", func() {
+					err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, &corev1.Secret{})
+					Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+				})
+			})
+		})
+
+		When("the gcp service account is not a valid email", func() {
+			BeforeEach(func() {
+				serviceAccount.Annotations[controllers.AnnotationGCPServiceAccount] = `service-account@email", "type": "other`
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+			})
+
+			It("does not create the secret", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				secret := &corev1.Secret{}
+				err := k8sClient.Get(ctx, client.ObjectKey{
+					Namespace: namespace,
+					Name:      secretName,
+				}, secret)
+				Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+			})
+
+			It("reports the invalid configuration", func() {
+				Expect(recorder.Events).To(Receive(ContainSubstring(controllers.ReasonInvalidConfiguration)))
+
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", controllers.ConditionSecretSynced),
+					HaveField("Status", metav1.ConditionFalse),
+					HaveField("Reason", controllers.ReasonInvalidConfiguration),
+				)))
+			})
+		})
+
+		When("a secret not managed by the operator already exists", func() {
+			BeforeEach(func() {
+				unmanagedSecret := &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      secretName,
+						Namespace: namespace,
+					},
+					StringData: map[string]string{
+						"config": "user-data",
+					},
+				}
+				Expect(k8sClient.Create(ctx, unmanagedSecret)).To(Succeed())
+			})
+
+			It("does not overwrite the secret", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+				Expect(result.RequeueAfter).To(Equal(controllers.SecretConflictRequeueAfter))
+
+				secret := &corev1.Secret{}
+				err := k8sClient.Get(ctx, client.ObjectKey{
+					Namespace: namespace,
+					Name:      secretName,
+				}, secret)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(secret.Data["config"])).To(Equal("user-data"))
+				Expect(secret.Type).To(Equal(corev1.SecretTypeOpaque))
+			})
+
+			It("reports the conflict", func() {
+				Expect(recorder.Events).To(Receive(ContainSubstring(controllers.ReasonSecretConflict)))
+
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", controllers.ConditionSecretSynced),
+					HaveField("Status", metav1.ConditionFalse),
+					HaveField("Reason", controllers.ReasonSecretConflict),
+				)))
+			})
+
+			It("reports the conflict as the reason the service account is not ready", func() {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				status, err := controllers.GetWorkloadIdentityStatus(serviceAccount)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(status.Conditions).To(ContainElement(SatisfyAll(
+					HaveField("Type", controllers.ConditionReady),
+					HaveField("Status", metav1.ConditionFalse),
+					HaveField("Reason", controllers.ReasonSecretConflict),
+				)))
+			})
+
+			When("the secret name fallback is enabled", func() {
+				BeforeEach(func() {
+					reconciler.SecretNameFallback = true
+				})
+
+				JustBeforeEach(func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+					Expect(result.Requeue).To(BeTrue())
+
+					result, reconcilErr = reconciler.Reconcile(ctx, reconcile.Request{
+						NamespacedName: client.ObjectKeyFromObject(serviceAccount),
+					})
+				})
+
+				It("creates the credentials under a fallback name", func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+
+					Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+					fallbackName := controllers.CredentialsSecretName(serviceAccount)
+					Expect(fallbackName).NotTo(Equal(secretName))
+					Expect(fallbackName).To(HavePrefix(secretName))
+
+					secret := &corev1.Secret{}
+					err := k8sClient.Get(ctx, client.ObjectKey{
+						Namespace: namespace,
+						Name:      fallbackName,
+					}, secret)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(secret.Data).To(HaveKey(controllers.SecretKeyGoogleApplicationCredentials))
+				})
+			})
+		})
+
+		When("the annotation is removed", func() {
+			JustBeforeEach(func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				delete(serviceAccount.Annotations, controllers.AnnotationGCPServiceAccount)
+				Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+
+				result, reconcilErr = reconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: client.ObjectKeyFromObject(serviceAccount),
+				})
+			})
+
+			It("deletes the secret", func() {
+				Expect(reconcilErr).NotTo(HaveOccurred())
+
+				secret := &corev1.Secret{}
+				err := k8sClient.Get(ctx, client.ObjectKey{
+					Namespace: namespace,
+					Name:      secretName,
+				}, secret)
+				Expect(k8serrors.IsNotFound(err)).To(BeTrue())
+			})
+
+			It("removes the status", func() {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), serviceAccount)).To(Succeed())
+				Expect(serviceAccount.Annotations).NotTo(HaveKey(controllers.AnnotationStatus))
+				Expect(serviceAccount.Annotations).NotTo(HaveKey(controllers.AnnotationReady))
+			})
+
+			It("records the deletion of the secret", func() {
+				Eventually(recorder.Events).Should(Receive(HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeNormal, controllers.EventReasonSecretDeleted))))
+			})
+
+			When("the secret is not managed by the operator", func() {
+				BeforeEach(func() {
+					delete(serviceAccount.Annotations, controllers.AnnotationGCPServiceAccount)
+					Expect(k8sClient.Update(ctx, serviceAccount)).To(Succeed())
+
+					unmanagedSecret := &corev1.Secret{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      secretName,
+							Namespace: namespace,
+						},
+						StringData: map[string]string{
+							"config": "user-data",
+						},
+					}
+					Expect(k8sClient.Create(ctx, unmanagedSecret)).To(Succeed())
+				})
+
+				It("does not delete the secret", func() {
+					Expect(reconcilErr).NotTo(HaveOccurred())
+
+					secret := &corev1.Secret{}
+					err := k8sClient.Get(ctx, client.ObjectKey{
+						Namespace: namespace,
+						Name:      secretName,
+					}, secret)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(secret.Data["config"])).To(Equal("user-data"))
+				})
+			})
+		})
+
 		When("the service account is updated", func() {
 			const newGCPServiceAccount string = "gcp-service-account@gcp.co"
 
@@ -177,3 +830,162 @@ var _ = Describe("Service Account Reconcilation", func() {
 		})
 	})
 })
+
+func getCredentialConfig(ctx context.Context, secretName string) *credentialconfig.Config {
+	secret := &corev1.Secret{}
+	err := k8sClient.Get(ctx, client.ObjectKey{
+		Namespace: namespace,
+		Name:      secretName,
+	}, secret)
+	Expect(err).NotTo(HaveOccurred())
+
+	config, err := credentialconfig.Parse(secret.Data[controllers.SecretKeyGoogleApplicationCredentials])
+	Expect(err).NotTo(HaveOccurred())
+
+	return config
+}
+
+var _ = Describe("Service Account Controller", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		timeout  = time.Second * 10
+		interval = time.Millisecond * 250
+
+		serviceAccountName string
+		secretName         string
+
+		serviceAccount *corev1.ServiceAccount
+	)
+
+	SetDefaultEventuallyPollingInterval(interval)
+	SetDefaultEventuallyTimeout(timeout)
+
+	getCredentialsAudience := func() (string, error) {
+		secret := &corev1.Secret{}
+		err := k8sClient.Get(ctx, client.ObjectKey{
+			Namespace: namespace,
+			Name:      secretName,
+		}, secret)
+		if err != nil {
+			return "", err
+		}
+
+		credentials := struct {
+			Audience string `json:"audience"`
+		}{}
+		err = json.Unmarshal(secret.Data[controllers.SecretKeyGoogleApplicationCredentials], &credentials)
+
+		return credentials.Audience, err
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		serviceAccountName = "the-service-account"
+		secretName = fmt.Sprintf("%s-%s", serviceAccountName, controllers.SecretNameSuffix)
+
+		tests.EnsureMembershipSecretExists(k8sClient, "old.svc.id.goog", "https://old.default.local")
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:             scheme,
+			MetricsBindAddress: "0",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		membershipStore := controllers.NewMembershipStore(mgr.GetClient(), mgr.GetCache(), ctrl.Log.WithName("membership-store"))
+		Expect(mgr.Add(membershipStore)).To(Succeed())
+
+		reconciler := &controllers.ServiceAccountReconciler{
+			Client:     mgr.GetClient(),
+			Logger:     ctrl.Log.WithName("service-account-reconciler"),
+			Scheme:     scheme,
+			Recorder:   mgr.GetEventRecorderFor("workload-identity-operator-gcp"),
+			Membership: membershipStore,
+		}
+		Expect(reconciler.SetupWithManager(mgr)).To(Succeed())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+
+		serviceAccount = &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      serviceAccountName,
+				Namespace: namespace,
+				Annotations: map[string]string{
+					controllers.AnnotationGCPServiceAccount: "service-account@email",
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+
+		Eventually(getCredentialsAudience).Should(Equal("identitynamespace:old.svc.id.goog:https://old.default.local"))
+	})
+
+	AfterEach(func() {
+		cancel()
+
+		membershipSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			},
+		}
+		Expect(k8sClient.Delete(context.Background(), membershipSecret)).To(Succeed())
+	})
+
+	When("the credentials secret is deleted", func() {
+		BeforeEach(func() {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      secretName,
+					Namespace: namespace,
+				},
+			}
+			Expect(k8sClient.Delete(ctx, secret)).To(Succeed())
+		})
+
+		It("recreates the secret", func() {
+			Eventually(getCredentialsAudience).Should(Equal("identitynamespace:old.svc.id.goog:https://old.default.local"))
+		})
+	})
+
+	When("the credentials secret is modified", func() {
+		BeforeEach(func() {
+			secret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Name:      secretName,
+				Namespace: namespace,
+			}, secret)).To(Succeed())
+
+			secret.Data[controllers.SecretKeyGoogleApplicationCredentials] = []byte(`{"audience":"tampered"}`)
+			Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+		})
+
+		It("restores the expected credentials", func() {
+			Eventually(getCredentialsAudience).Should(Equal("identitynamespace:old.svc.id.goog:https://old.default.local"))
+		})
+	})
+
+	When("the membership changes", func() {
+		BeforeEach(func() {
+			membershipSecret := &corev1.Secret{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			}, membershipSecret)).To(Succeed())
+
+			membershipSecret.Data[controllers.SecretKeyGoogleApplicationCredentials] = []byte(
+				`{"workloadIdentityPool":"new.svc.id.goog","identityProvider":"https://new.default.local"}`,
+			)
+			Expect(k8sClient.Update(ctx, membershipSecret)).To(Succeed())
+		})
+
+		It("regenerates the credentials of the annotated service accounts", func() {
+			Eventually(getCredentialsAudience).Should(Equal("identitynamespace:new.svc.id.goog:https://new.default.local"))
+		})
+	})
+})
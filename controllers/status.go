@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AnnotationStatus holds the JSON encoded WorkloadIdentityStatus of a
+	// ServiceAccount, as ServiceAccounts don't have a status subresource.
+	AnnotationStatus = "giantswarm.io/workload-identity-status"
+	// AnnotationReady mirrors the status of the Ready condition, so that it
+	// can be used in kubectl jsonpath expressions and health checks.
+	AnnotationReady = "giantswarm.io/workload-identity-ready"
+
+	// ConditionReady summarises the other conditions. It is true when the
+	// credentials of the ServiceAccount are ready to be used by pods.
+	ConditionReady               = "Ready"
+	ConditionMembershipAvailable = "MembershipAvailable"
+	ConditionPolicyAllowed       = "PolicyAllowed"
+	ConditionSecretSynced        = "SecretSynced"
+
+	ReasonReady                 = "Ready"
+	ReasonPending               = "Pending"
+	ReasonMembershipAvailable   = "MembershipAvailable"
+	ReasonMembershipUnavailable = "MembershipUnavailable"
+	ReasonPolicyAllowed         = "PolicyAllowed"
+	ReasonSecretSynced          = "SecretSynced"
+	ReasonSecretConflict        = "SecretConflict"
+	ReasonInvalidConfiguration  = "InvalidConfiguration"
+)
+
+// readinessConditions are the conditions that must be true for a
+// ServiceAccount to be Ready, in the order they are checked.
+var readinessConditions = []string{
+	ConditionMembershipAvailable,
+	ConditionPolicyAllowed,
+	ConditionSecretSynced,
+}
+
+// WorkloadIdentityStatus is the status of the workload identity setup of a
+// ServiceAccount.
+type WorkloadIdentityStatus struct {
+	// ObservedConfiguration is the hash of the workload identity
+	// configuration the status was computed from, i.e. the annotations the
+	// credentials are generated from and the selected membership. The API
+	// server doesn't set the generation of ServiceAccounts, so it can't be
+	// used to tell whether the status is up to date.
+	ObservedConfiguration string             `json:"observedConfiguration,omitempty"`
+	Conditions            []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// GetWorkloadIdentityStatus returns the status stored on the given
+// ServiceAccount.
+func GetWorkloadIdentityStatus(serviceAccount *corev1.ServiceAccount) (WorkloadIdentityStatus, error) {
+	status := WorkloadIdentityStatus{}
+
+	encoded, ok := serviceAccount.Annotations[AnnotationStatus]
+	if !ok {
+		return status, nil
+	}
+
+	err := json.Unmarshal([]byte(encoded), &status)
+	return status, err
+}
+
+// IsWorkloadIdentityReady reports whether the operator has reported the
+// credentials of the ServiceAccount as ready, whether it is configured with
+// annotations or with a WorkloadIdentityBinding.
+func IsWorkloadIdentityReady(serviceAccount *corev1.ServiceAccount) bool {
+	return serviceAccount.Annotations[AnnotationReady] == string(metav1.ConditionTrue)
+}
+
+// ObservedConfiguration returns the hash of the workload identity
+// configuration made of the given annotations and membership name, as
+// reported in the ObservedConfiguration field of the status.
+func ObservedConfiguration(annotations map[string]string, membershipName string) string {
+	hash := sha256.New()
+	for _, key := range reconciledAnnotations {
+		value, ok := annotations[key]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(hash, "%s=%q\n", key, value)
+	}
+	fmt.Fprintf(hash, "membership=%q\n", membershipName)
+
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// setConditions sets the given conditions in the status of the
+// ServiceAccount and updates the Ready condition accordingly. The
+// ServiceAccount is only patched when the status has changed.
+func (r *ServiceAccountReconciler) setConditions(ctx context.Context, serviceAccount *corev1.ServiceAccount, observedConfiguration string, conditions ...metav1.Condition) error {
+	status, err := GetWorkloadIdentityStatus(serviceAccount)
+	if err != nil {
+		r.Logger.Error(err, "ignoring invalid workload identity status")
+		status = WorkloadIdentityStatus{}
+	}
+
+	status.ObservedConfiguration = observedConfiguration
+
+	for _, condition := range conditions {
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+
+	ready := readyCondition(status.Conditions)
+	meta.SetStatusCondition(&status.Conditions, ready)
+
+	encoded, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	return r.updateAnnotations(ctx, serviceAccount, func(annotations map[string]string) {
+		annotations[AnnotationStatus] = string(encoded)
+		annotations[AnnotationReady] = string(ready.Status)
+	})
+}
+
+// clearStatus removes the status of a ServiceAccount that is no longer
+// managed by the operator.
+func (r *ServiceAccountReconciler) clearStatus(ctx context.Context, serviceAccount *corev1.ServiceAccount) error {
+	return r.updateAnnotations(ctx, serviceAccount, func(annotations map[string]string) {
+		delete(annotations, AnnotationStatus)
+		delete(annotations, AnnotationReady)
+	})
+}
+
+// readyCondition returns the Ready condition summarising the given
+// conditions. It reports the first condition that is not true. Conditions
+// that are not set yet are only reported when no other condition is false,
+// as the reconciliation stops at the first failure, e.g. a Secret conflict
+// is detected before the policy is evaluated.
+func readyCondition(conditions []metav1.Condition) metav1.Condition {
+	for _, conditionType := range readinessConditions {
+		condition := meta.FindStatusCondition(conditions, conditionType)
+		if condition != nil && condition.Status != metav1.ConditionTrue {
+			return conditionFalse(ConditionReady, condition.Reason, condition.Message)
+		}
+	}
+
+	for _, conditionType := range readinessConditions {
+		if meta.FindStatusCondition(conditions, conditionType) == nil {
+			return conditionFalse(ConditionReady, ReasonPending, "Waiting for condition "+conditionType)
+		}
+	}
+
+	return conditionTrue(ConditionReady, ReasonReady, "Workload identity credentials are ready")
+}
+
+func conditionTrue(conditionType, reason, message string) metav1.Condition {
+	return metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+func conditionFalse(conditionType, reason, message string) metav1.Condition {
+	return metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	}
+}
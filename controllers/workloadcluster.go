@@ -0,0 +1,359 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	capi "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/cluster-api/util/secret"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// LocalClusterName labels the metrics of the ServiceAccounts of the
+	// cluster the operator runs in.
+	LocalClusterName = "local"
+
+	// WorkloadClusterRetryAfter is the delay before connecting again to a
+	// workload cluster whose ServiceAccounts could not be watched.
+	WorkloadClusterRetryAfter = time.Minute
+)
+
+// WorkloadClusterReconciler runs on management clusters. It watches the
+// kubeconfig Secrets written by Cluster API and runs a
+// ServiceAccountReconciler against every workload cluster, so that a single
+// operator deployment manages the ServiceAccounts of all the clusters.
+// Clusters are added and removed with their kubeconfig Secret.
+type WorkloadClusterReconciler struct {
+	client.Client
+	Scheme  *runtime.Scheme
+	Logger  logr.Logger
+	Manager manager.Manager
+
+	// Template holds the configuration of the ServiceAccountReconcilers
+	// running against the workload clusters. Their client, recorder, logger
+	// and cluster name are set for each workload cluster. Unless the
+	// template uses a standalone MembershipStore, each workload cluster uses
+	// the memberships stored in that cluster.
+	Template ServiceAccountReconciler
+
+	// kubeconfigs caches the Secrets written by Cluster API, as the cache of
+	// the manager only holds the Secrets managed by the operator.
+	kubeconfigs cluster.Cluster
+
+	mutex    sync.Mutex
+	clusters map[k8stypes.NamespacedName]*workloadCluster
+	retries  chan event.GenericEvent
+}
+
+type workloadCluster struct {
+	name       string
+	kubeconfig []byte
+	cancel     context.CancelFunc
+
+	// membershipCollector exposes the memberships stored in the workload
+	// cluster. It is nil when the cluster uses a standalone membership.
+	membershipCollector prometheus.Collector
+}
+
+func (r *WorkloadClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Logger.WithValues("kubeconfig", req.NamespacedName)
+
+	kubeconfigSecret := &corev1.Secret{}
+	err := r.kubeconfigs.GetClient().Get(ctx, req.NamespacedName, kubeconfigSecret)
+	if k8serrors.IsNotFound(err) {
+		r.stopCluster(req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		logger.Error(err, "could not get kubeconfig secret")
+		return reconcile.Result{}, err
+	}
+
+	if !kubeconfigSecret.DeletionTimestamp.IsZero() || !isKubeconfigSecret(kubeconfigSecret) {
+		r.stopCluster(req.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+
+	kubeconfig := kubeconfigSecret.Data[secret.KubeconfigDataName]
+
+	r.mutex.Lock()
+	running, ok := r.clusters[req.NamespacedName]
+	r.mutex.Unlock()
+
+	if ok && bytes.Equal(running.kubeconfig, kubeconfig) {
+		return reconcile.Result{}, nil
+	}
+
+	if ok {
+		logger.Info("Kubeconfig changed, reconnecting to workload cluster")
+		r.stopCluster(req.NamespacedName)
+	}
+
+	err = r.startCluster(ctx, kubeconfigSecret, kubeconfig)
+	if err != nil {
+		logger.Error(err, "failed to start workload cluster controller")
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// startCluster starts a ServiceAccountReconciler against the workload
+// cluster of the given kubeconfig Secret. It runs until the cluster is
+// stopped or the manager stops. ctx is the context of the manager and bounds
+// the retries of a cluster whose controller failed.
+func (r *WorkloadClusterReconciler) startCluster(ctx context.Context, kubeconfigSecret *corev1.Secret, kubeconfig []byte) error {
+	key := client.ObjectKeyFromObject(kubeconfigSecret)
+	clusterName := kubeconfigSecret.Labels[capi.ClusterLabelName]
+	logger := r.Logger.WithValues("cluster", clusterName)
+
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return fmt.Errorf("invalid kubeconfig for cluster %q: %w", clusterName, err)
+	}
+
+	workloadClusterObj, err := cluster.New(restConfig, func(options *cluster.Options) {
+		options.Scheme = r.Scheme
+		options.NewCache = NewCacheFunc(r.Template.Namespaces, ManagedSecretSelector)
+	})
+	if err != nil {
+		return err
+	}
+
+	bindingsInstalled, err := BindingsInstalled(workloadClusterObj.GetRESTMapper())
+	if err != nil {
+		return err
+	}
+	if !bindingsInstalled {
+		logger.Info("WorkloadIdentityBinding CRD is not installed, ignoring bindings")
+	}
+
+	var membershipCluster cluster.Cluster
+	if r.Template.Membership == nil || !r.Template.Membership.Standalone() {
+		membershipCluster, err = NewMembershipCluster(restConfig, r.Scheme)
+		if err != nil {
+			return err
+		}
+	}
+
+	clusterCtx, cancel := context.WithCancel(context.Background())
+
+	reconciler := r.Template
+	reconciler.Client = workloadClusterObj.GetClient()
+	reconciler.APIReader = workloadClusterObj.GetAPIReader()
+	reconciler.Scheme = r.Scheme
+	reconciler.Logger = logger.WithName("service-account-reconciler")
+	reconciler.Recorder = workloadClusterObj.GetEventRecorderFor("workload-identity-operator-gcp")
+	reconciler.ClusterName = clusterName
+	reconciler.DisableBindings = !bindingsInstalled
+
+	var membershipCollector prometheus.Collector
+	if membershipCluster != nil {
+		reconciler.Membership = NewMembershipStore(
+			membershipCluster.GetAPIReader(),
+			membershipCluster.GetCache(),
+			logger.WithName("membership-store"),
+		)
+		membershipCollector = NewMembershipCollector(clusterName, reconciler.Membership)
+	}
+
+	options := reconciler.controllerOptions()
+	options.Reconciler = &reconciler
+
+	serviceAccountController, err := controller.NewUnmanaged(fmt.Sprintf("serviceaccount-%s-%s", key.Namespace, clusterName), r.Manager, options)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	err = reconciler.watchCluster(clusterCtx, serviceAccountController, workloadClusterObj)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	running := &workloadCluster{
+		name:       clusterName,
+		kubeconfig: kubeconfig,
+		cancel:     cancel,
+	}
+
+	if membershipCollector != nil {
+		err = metrics.Registry.Register(membershipCollector)
+		if err != nil {
+			logger.Error(err, "could not register membership metrics")
+		} else {
+			running.membershipCollector = membershipCollector
+		}
+	}
+
+	r.mutex.Lock()
+	r.clusters[key] = running
+	workloadClustersGauge.Set(float64(len(r.clusters)))
+	r.mutex.Unlock()
+
+	go func() {
+		err := workloadClusterObj.Start(clusterCtx)
+		if err != nil {
+			logger.Error(err, "workload cluster cache stopped")
+		}
+	}()
+
+	if membershipCluster != nil {
+		go func() {
+			err := membershipCluster.Start(clusterCtx)
+			if err != nil {
+				logger.Error(err, "workload cluster membership cache stopped")
+			}
+		}()
+	}
+
+	go func() {
+		err := reconciler.Membership.Start(clusterCtx)
+		if err != nil {
+			logger.Error(err, "membership store stopped")
+		}
+	}()
+
+	go func() {
+		err := serviceAccountController.Start(clusterCtx)
+		if err == nil || clusterCtx.Err() != nil {
+			return
+		}
+
+		logger.Error(err, "workload cluster controller stopped, retrying", "retry-after", WorkloadClusterRetryAfter)
+		r.removeCluster(key, running)
+
+		// Nothing reads the retries once the manager stops.
+		time.AfterFunc(WorkloadClusterRetryAfter, func() {
+			select {
+			case r.retries <- event.GenericEvent{Object: kubeconfigSecret}:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	logger.Info("Started reconciling workload cluster")
+	return nil
+}
+
+// stopCluster stops reconciling the workload cluster of the given kubeconfig
+// Secret, if it is running.
+func (r *WorkloadClusterReconciler) stopCluster(key k8stypes.NamespacedName) {
+	r.removeCluster(key, nil)
+}
+
+// removeCluster stops the given workload cluster. When expected is not nil,
+// the cluster is only stopped if it has not been restarted in the meantime.
+func (r *WorkloadClusterReconciler) removeCluster(key k8stypes.NamespacedName, expected *workloadCluster) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	running, ok := r.clusters[key]
+	if !ok || (expected != nil && running != expected) {
+		return
+	}
+
+	running.cancel()
+	delete(r.clusters, key)
+	managedServiceAccounts.removeCluster(running.name)
+	if running.membershipCollector != nil {
+		metrics.Registry.Unregister(running.membershipCollector)
+	}
+	workloadClustersGauge.Set(float64(len(r.clusters)))
+
+	r.Logger.Info("Stopped reconciling workload cluster", "cluster", running.name)
+}
+
+// stopAllClusters stops reconciling all the workload clusters. It is called
+// when the manager stops.
+func (r *WorkloadClusterReconciler) stopAllClusters(ctx context.Context) error {
+	<-ctx.Done()
+
+	r.mutex.Lock()
+	keys := make([]k8stypes.NamespacedName, 0, len(r.clusters))
+	for key := range r.clusters {
+		keys = append(keys, key)
+	}
+	r.mutex.Unlock()
+
+	for _, key := range keys {
+		r.stopCluster(key)
+	}
+
+	return nil
+}
+
+// isKubeconfigSecret reports whether the Secret is the kubeconfig of a
+// Cluster API workload cluster.
+func isKubeconfigSecret(obj client.Object) bool {
+	clusterName, ok := obj.GetLabels()[capi.ClusterLabelName]
+	if !ok || isEmpty(clusterName) {
+		return false
+	}
+
+	return obj.GetName() == secret.Name(clusterName, secret.Kubeconfig)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *WorkloadClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.clusters = map[k8stypes.NamespacedName]*workloadCluster{}
+	r.retries = make(chan event.GenericEvent)
+
+	var err error
+	r.kubeconfigs, err = cluster.New(mgr.GetConfig(), func(options *cluster.Options) {
+		options.Scheme = mgr.GetScheme()
+		options.NewCache = NewCacheFunc(nil, KubeconfigSecretSelector)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = mgr.Add(r.kubeconfigs)
+	if err != nil {
+		return err
+	}
+
+	err = mgr.Add(manager.RunnableFunc(r.stopAllClusters))
+	if err != nil {
+		return err
+	}
+
+	c, err := controller.New("workloadcluster", mgr, controller.Options{
+		Reconciler: r,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(source.NewKindWithCache(&corev1.Secret{}, r.kubeconfigs.GetCache()),
+		&handler.EnqueueRequestForObject{},
+		predicate.NewPredicateFuncs(isKubeconfigSecret),
+	)
+	if err != nil {
+		return err
+	}
+
+	return c.Watch(&source.Channel{Source: r.retries}, &handler.EnqueueRequestForObject{})
+}
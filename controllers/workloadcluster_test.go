@@ -0,0 +1,184 @@
+package controllers_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+	"github.com/giantswarm/workload-identity-operator-gcp/tests"
+)
+
+var _ = Describe("Workload Cluster Controller", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		timeout  = time.Second * 10
+		interval = time.Millisecond * 250
+
+		kubeconfigSecret *corev1.Secret
+	)
+
+	SetDefaultEventuallyPollingInterval(interval)
+	SetDefaultEventuallyTimeout(timeout)
+	SetDefaultConsistentlyDuration(time.Second * 2)
+	SetDefaultConsistentlyPollingInterval(interval)
+
+	createServiceAccount := func(name string) {
+		serviceAccount := &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Annotations: map[string]string{
+					controllers.AnnotationGCPServiceAccount: "service-account@email",
+				},
+			},
+		}
+		Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+	}
+
+	getCredentialsSecret := func(serviceAccountName string) func() error {
+		return func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{
+				Namespace: namespace,
+				Name:      controllers.DefaultCredentialsSecretName(serviceAccountName),
+			}, &corev1.Secret{})
+		}
+	}
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		tests.EnsureMembershipSecretExists(k8sClient, "remote.svc.id.goog", "https://remote.default.local")
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme:             scheme,
+			MetricsBindAddress: "0",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		reconciler := &controllers.WorkloadClusterReconciler{
+			Client:  mgr.GetClient(),
+			Logger:  ctrl.Log.WithName("workload-cluster-reconciler"),
+			Scheme:  scheme,
+			Manager: mgr,
+		}
+		Expect(reconciler.SetupWithManager(mgr)).To(Succeed())
+
+		go func() {
+			defer GinkgoRecover()
+			Expect(mgr.Start(ctx)).To(Succeed())
+		}()
+
+		// The test environment acts as both the management and the workload
+		// cluster.
+		kubeconfig, err := KubeConfigFromREST(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		kubeconfigSecret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "the-cluster-kubeconfig",
+				Namespace: namespace,
+				Labels: map[string]string{
+					"cluster.x-k8s.io/cluster-name": "the-cluster",
+				},
+			},
+			Data: map[string][]byte{
+				"value": kubeconfig,
+			},
+		}
+		Expect(k8sClient.Create(ctx, kubeconfigSecret)).To(Succeed())
+
+		createServiceAccount("the-remote-service-account")
+	})
+
+	AfterEach(func() {
+		cancel()
+
+		membershipSecret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      controllers.MembershipSecretName,
+				Namespace: controllers.DefaultMembershipSecretNamespace,
+			},
+		}
+		Expect(k8sClient.Delete(context.Background(), membershipSecret)).To(Succeed())
+	})
+
+	It("reconciles the service accounts of the workload cluster", func() {
+		Eventually(getCredentialsSecret("the-remote-service-account")).Should(Succeed())
+	})
+
+	It("labels the metrics with the workload cluster", func() {
+		Eventually(func() float64 {
+			return getGaugeValue("workload_identity_reconciler_managed_service_accounts", map[string]string{
+				"cluster": "the-cluster",
+				"synced":  "true",
+			})
+		}).Should(BeNumerically(">=", 1))
+	})
+
+	It("reports the memberships of the workload cluster", func() {
+		Eventually(func() float64 {
+			return getGaugeValue("workload_identity_membership_loaded", map[string]string{
+				"cluster":    "the-cluster",
+				"membership": controllers.DefaultMembershipLabel,
+			})
+		}).Should(Equal(1.0))
+	})
+
+	When("the kubeconfig secret is deleted", func() {
+		BeforeEach(func() {
+			Eventually(getCredentialsSecret("the-remote-service-account")).Should(Succeed())
+			Expect(k8sClient.Delete(ctx, kubeconfigSecret)).To(Succeed())
+
+			Eventually(func() float64 {
+				return getGaugeValue("workload_identity_reconciler_workload_clusters", nil)
+			}).Should(BeZero())
+			Expect(getGaugeValue("workload_identity_membership_loaded", map[string]string{
+				"cluster": "the-cluster",
+			})).To(Equal(-1.0))
+
+			createServiceAccount("the-new-service-account")
+		})
+
+		It("stops reconciling the workload cluster", func() {
+			Consistently(getCredentialsSecret("the-new-service-account")).ShouldNot(Succeed())
+		})
+	})
+})
+
+// getGaugeValue returns the value of the gauge with the given name and
+// labels, or -1 if it has not been reported.
+func getGaugeValue(name string, labels map[string]string) float64 {
+	families, err := metrics.Registry.Gather()
+	Expect(err).NotTo(HaveOccurred())
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			matches := 0
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] == label.GetValue() {
+					matches++
+				}
+			}
+
+			if matches == len(labels) {
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,329 @@
+// Package credentialconfig renders the external account credential
+// configuration files used by the Google Cloud client libraries to exchange
+// a Kubernetes ServiceAccount token for Google credentials.
+//
+// See https://google.aip.dev/auth/4117 for the format of the file.
+package credentialconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	TypeExternalAccount = "external_account"
+	SubjectTokenTypeJWT = "urn:ietf:params:oauth:token-type:jwt"
+
+	DefaultUniverseDomain         = "googleapis.com"
+	DefaultTokenURL               = "https://sts.googleapis.com/v1/token"
+	DefaultIAMCredentialsEndpoint = "https://iamcredentials.googleapis.com"
+
+	// MinTokenLifetime and MaxTokenLifetime are the bounds of the lifetime
+	// of impersonated access tokens accepted by the IAM credentials API.
+	MinTokenLifetime = 10 * time.Minute
+	MaxTokenLifetime = 12 * time.Hour
+
+	workforcePoolAudiencePrefix = "//iam.googleapis.com/locations/global/workforcePools/"
+)
+
+var ErrInvalidConfig = errors.New("invalid credential configuration")
+
+var (
+	serviceAccountEmailRegexp = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+$`)
+	projectIDRegexp           = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+	projectNumberRegexp       = regexp.MustCompile(`^[0-9]+$`)
+	domainRegexp              = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+	impersonationPathRegexp   = regexp.MustCompile(`^/v1/projects/-/serviceAccounts/([^/]+):generateAccessToken$`)
+)
+
+// Config is an external account credential configuration.
+type Config struct {
+	Type                           string                       `json:"type"`
+	Audience                       string                       `json:"audience"`
+	SubjectTokenType               string                       `json:"subject_token_type"`
+	TokenURL                       string                       `json:"token_url"`
+	ServiceAccountImpersonationURL string                       `json:"service_account_impersonation_url,omitempty"`
+	ServiceAccountImpersonation    *ServiceAccountImpersonation `json:"service_account_impersonation,omitempty"`
+	CredentialSource               CredentialSource             `json:"credential_source"`
+	QuotaProjectID                 string                       `json:"quota_project_id,omitempty"`
+	UniverseDomain                 string                       `json:"universe_domain,omitempty"`
+	WorkforcePoolUserProject       string                       `json:"workforce_pool_user_project,omitempty"`
+}
+
+type ServiceAccountImpersonation struct {
+	TokenLifetimeSeconds int64 `json:"token_lifetime_seconds,omitempty"`
+}
+
+type CredentialSource struct {
+	File string `json:"file"`
+}
+
+// Builder builds a validated Config. The zero value is not usable, use
+// NewBuilder instead.
+type Builder struct {
+	config Config
+
+	serviceAccount         string
+	iamCredentialsEndpoint string
+	tokenLifetime          time.Duration
+}
+
+// NewBuilder returns a Builder for a Config exchanging the token stored in
+// tokenFile with the given audience.
+func NewBuilder(audience, tokenFile string) *Builder {
+	return &Builder{
+		config: Config{
+			Type:             TypeExternalAccount,
+			Audience:         audience,
+			SubjectTokenType: SubjectTokenTypeJWT,
+			TokenURL:         DefaultTokenURL,
+			CredentialSource: CredentialSource{
+				File: tokenFile,
+			},
+		},
+		iamCredentialsEndpoint: DefaultIAMCredentialsEndpoint,
+	}
+}
+
+// WithTokenURL sets the URL of the Security Token Service.
+func (b *Builder) WithTokenURL(tokenURL string) *Builder {
+	b.config.TokenURL = tokenURL
+	return b
+}
+
+// WithServiceAccountImpersonation makes the credentials impersonate the GCP
+// service account with the given email.
+func (b *Builder) WithServiceAccountImpersonation(serviceAccount string) *Builder {
+	b.serviceAccount = serviceAccount
+	return b
+}
+
+// WithIAMCredentialsEndpoint sets the endpoint of the IAM credentials API
+// used for service account impersonation.
+func (b *Builder) WithIAMCredentialsEndpoint(endpoint string) *Builder {
+	b.iamCredentialsEndpoint = endpoint
+	return b
+}
+
+// WithTokenLifetime sets the lifetime of the impersonated access tokens.
+func (b *Builder) WithTokenLifetime(lifetime time.Duration) *Builder {
+	b.tokenLifetime = lifetime
+	return b
+}
+
+// WithQuotaProject sets the project used for quota and billing.
+func (b *Builder) WithQuotaProject(projectID string) *Builder {
+	b.config.QuotaProjectID = projectID
+	return b
+}
+
+// WithUniverseDomain sets the universe domain of the credentials.
+func (b *Builder) WithUniverseDomain(domain string) *Builder {
+	b.config.UniverseDomain = domain
+	return b
+}
+
+// WithWorkforcePoolUserProject sets the project used for quota and billing
+// of workforce pool identities.
+func (b *Builder) WithWorkforcePoolUserProject(project string) *Builder {
+	b.config.WorkforcePoolUserProject = project
+	return b
+}
+
+// Build returns the validated Config.
+func (b *Builder) Build() (*Config, error) {
+	config := b.config
+
+	if b.serviceAccount != "" {
+		err := ValidateServiceAccount(b.serviceAccount)
+		if err != nil {
+			return nil, err
+		}
+		config.ServiceAccountImpersonationURL = ImpersonationURL(b.iamCredentialsEndpoint, b.serviceAccount)
+	}
+
+	if b.tokenLifetime != 0 {
+		if b.tokenLifetime%time.Second != 0 {
+			return nil, invalidf("token lifetime %s is not a whole number of seconds", b.tokenLifetime)
+		}
+		config.ServiceAccountImpersonation = &ServiceAccountImpersonation{
+			TokenLifetimeSeconds: int64(b.tokenLifetime / time.Second),
+		}
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// ValidateServiceAccount checks that the GCP service account can be
+// impersonated, i.e. that it is a valid email.
+func ValidateServiceAccount(serviceAccount string) error {
+	if !serviceAccountEmailRegexp.MatchString(serviceAccount) {
+		return invalidf("service account %q is not a valid email", serviceAccount)
+	}
+
+	return nil
+}
+
+// ImpersonationURL returns the URL used to generate access tokens for the
+// given GCP service account.
+func ImpersonationURL(iamCredentialsEndpoint, serviceAccount string) string {
+	return fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+		strings.TrimSuffix(iamCredentialsEndpoint, "/"), serviceAccount)
+}
+
+// Impersonating returns a copy of the Config impersonating the GCP service
+// account with the given email, through the given IAM credentials endpoint.
+// The other fields, e.g. the token lifetime, are kept. The endpoint is not
+// taken from the Config, as Configs without impersonation don't hold it.
+func (c *Config) Impersonating(iamCredentialsEndpoint, serviceAccount string) (*Config, error) {
+	err := ValidateServiceAccount(serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	config := *c
+	config.ServiceAccountImpersonationURL = ImpersonationURL(iamCredentialsEndpoint, serviceAccount)
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Validate checks that the Config is usable by the Google Cloud client
+// libraries.
+func (c *Config) Validate() error {
+	if c.Type != TypeExternalAccount {
+		return invalidf("type must be %q, got %q", TypeExternalAccount, c.Type)
+	}
+
+	if strings.TrimSpace(c.Audience) == "" {
+		return invalidf("audience must not be empty")
+	}
+
+	if strings.TrimSpace(c.SubjectTokenType) == "" {
+		return invalidf("subject token type must not be empty")
+	}
+
+	if strings.TrimSpace(c.CredentialSource.File) == "" {
+		return invalidf("credential source file must not be empty")
+	}
+
+	err := validateHTTPSURL("token url", c.TokenURL)
+	if err != nil {
+		return err
+	}
+
+	if c.ServiceAccountImpersonationURL != "" {
+		err = validateImpersonationURL(c.ServiceAccountImpersonationURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ServiceAccountImpersonation != nil {
+		if c.ServiceAccountImpersonationURL == "" {
+			return invalidf("token lifetime requires service account impersonation")
+		}
+
+		lifetime := time.Duration(c.ServiceAccountImpersonation.TokenLifetimeSeconds) * time.Second
+		if lifetime < MinTokenLifetime || lifetime > MaxTokenLifetime {
+			return invalidf("token lifetime must be between %s and %s, got %s", MinTokenLifetime, MaxTokenLifetime, lifetime)
+		}
+	}
+
+	if c.QuotaProjectID != "" && !projectIDRegexp.MatchString(c.QuotaProjectID) {
+		return invalidf("quota project %q is not a valid project id", c.QuotaProjectID)
+	}
+
+	if c.UniverseDomain != "" && !domainRegexp.MatchString(c.UniverseDomain) {
+		return invalidf("universe domain %q is not a valid domain", c.UniverseDomain)
+	}
+
+	if c.WorkforcePoolUserProject != "" {
+		if !strings.HasPrefix(c.Audience, workforcePoolAudiencePrefix) {
+			return invalidf("workforce pool user project requires a workforce pool audience")
+		}
+
+		if !projectIDRegexp.MatchString(c.WorkforcePoolUserProject) && !projectNumberRegexp.MatchString(c.WorkforcePoolUserProject) {
+			return invalidf("workforce pool user project %q is not a valid project", c.WorkforcePoolUserProject)
+		}
+	}
+
+	return nil
+}
+
+// Marshal validates the Config and returns its JSON encoding.
+func (c *Config) Marshal() ([]byte, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// Parse decodes and validates a JSON encoded Config.
+func Parse(data []byte) (*Config, error) {
+	config := &Config{}
+
+	err := json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidConfig, err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func validateHTTPSURL(name, value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return invalidf("%s %q is not a valid url: %s", name, value, err)
+	}
+
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return invalidf("%s %q must be an absolute https url", name, value)
+	}
+
+	return nil
+}
+
+func validateImpersonationURL(value string) error {
+	err := validateHTTPSURL("service account impersonation url", value)
+	if err != nil {
+		return err
+	}
+
+	parsed, _ := url.Parse(value)
+	matches := impersonationPathRegexp.FindStringSubmatch(parsed.Path)
+	if matches == nil {
+		return invalidf("service account impersonation url %q has an unexpected path", value)
+	}
+
+	if !serviceAccountEmailRegexp.MatchString(matches[1]) {
+		return invalidf("service account %q is not a valid email", matches[1])
+	}
+
+	return nil
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,13 @@
+package credentialconfig_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCredentialConfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Credential Config Suite")
+}
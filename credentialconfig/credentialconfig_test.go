@@ -0,0 +1,196 @@
+package credentialconfig_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
+)
+
+var _ = Describe("Credential Config", func() {
+	const (
+		audience          = "identitynamespace:test.svc.id.goog:https://test.default.local"
+		tokenFile         = "/var/run/secrets/workload-identity/token"
+		gcpServiceAccount = "service-account@test.iam.gserviceaccount.com"
+	)
+
+	var builder *credentialconfig.Builder
+
+	BeforeEach(func() {
+		builder = credentialconfig.NewBuilder(audience, tokenFile)
+	})
+
+	It("renders the default configuration", func() {
+		config, err := builder.WithServiceAccountImpersonation(gcpServiceAccount).Build()
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := config.Marshal()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"type": "external_account",
+			"audience": "identitynamespace:test.svc.id.goog:https://test.default.local",
+			"service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/service-account@test.iam.gserviceaccount.com:generateAccessToken",
+			"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+			"token_url": "https://sts.googleapis.com/v1/token",
+			"credential_source": {
+				"file": "/var/run/secrets/workload-identity/token"
+			}
+		}`))
+	})
+
+	It("renders the optional fields", func() {
+		config, err := builder.
+			WithServiceAccountImpersonation(gcpServiceAccount).
+			WithTokenLifetime(2 * time.Hour).
+			WithQuotaProject("billing-project").
+			WithUniverseDomain("example.com").
+			Build()
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := config.Marshal()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+			"type": "external_account",
+			"audience": "identitynamespace:test.svc.id.goog:https://test.default.local",
+			"service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/service-account@test.iam.gserviceaccount.com:generateAccessToken",
+			"service_account_impersonation": {
+				"token_lifetime_seconds": 7200
+			},
+			"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+			"token_url": "https://sts.googleapis.com/v1/token",
+			"credential_source": {
+				"file": "/var/run/secrets/workload-identity/token"
+			},
+			"quota_project_id": "billing-project",
+			"universe_domain": "example.com"
+		}`))
+	})
+
+	It("omits the impersonation without a service account", func() {
+		config, err := builder.Build()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config.ServiceAccountImpersonationURL).To(BeEmpty())
+		Expect(config.ServiceAccountImpersonation).To(BeNil())
+	})
+
+	Describe("impersonating another service account", func() {
+		const otherServiceAccount = "other@test.iam.gserviceaccount.com"
+
+		It("keeps the IAM credentials endpoint and the token lifetime", func() {
+			config, err := builder.
+				WithServiceAccountImpersonation(gcpServiceAccount).
+				WithIAMCredentialsEndpoint("https://iamcredentials.example.com").
+				WithTokenLifetime(time.Hour).
+				Build()
+			Expect(err).NotTo(HaveOccurred())
+
+			impersonating, err := config.Impersonating("https://iamcredentials.example.com", otherServiceAccount)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(impersonating.ServiceAccountImpersonationURL).To(Equal(
+				"https://iamcredentials.example.com/v1/projects/-/serviceAccounts/other@test.iam.gserviceaccount.com:generateAccessToken"))
+			Expect(impersonating.ServiceAccountImpersonation).To(Equal(config.ServiceAccountImpersonation))
+			Expect(config.ServiceAccountImpersonationURL).To(ContainSubstring(gcpServiceAccount))
+		})
+
+		It("uses the given IAM credentials endpoint without impersonation", func() {
+			config, err := builder.WithUniverseDomain("example.com").Build()
+			Expect(err).NotTo(HaveOccurred())
+
+			impersonating, err := config.Impersonating("https://iamcredentials-psc.p.example.com", otherServiceAccount)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(impersonating.ServiceAccountImpersonationURL).To(HavePrefix("https://iamcredentials-psc.p.example.com/"))
+		})
+
+		It("rejects invalid service accounts", func() {
+			config, err := builder.Build()
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = config.Impersonating(credentialconfig.DefaultIAMCredentialsEndpoint, "not-an-email")
+			Expect(err).To(MatchError(credentialconfig.ErrInvalidConfig))
+		})
+	})
+
+	DescribeTable("round trips",
+		func(build func(*credentialconfig.Builder) *credentialconfig.Builder) {
+			config, err := build(builder).Build()
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := config.Marshal()
+			Expect(err).NotTo(HaveOccurred())
+
+			parsed, err := credentialconfig.Parse(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed).To(Equal(config))
+		},
+		Entry("without impersonation", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b
+		}),
+		Entry("with impersonation", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithServiceAccountImpersonation(gcpServiceAccount)
+		}),
+		Entry("with all optional fields", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithServiceAccountImpersonation(gcpServiceAccount).
+				WithIAMCredentialsEndpoint("https://iamcredentials.example.com/").
+				WithTokenURL("https://sts.example.com/v1/token").
+				WithTokenLifetime(time.Hour).
+				WithQuotaProject("billing-project").
+				WithUniverseDomain("example.com")
+		}),
+		Entry("with a workforce pool", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return credentialconfig.NewBuilder("//iam.googleapis.com/locations/global/workforcePools/pool/providers/provider", tokenFile).
+				WithWorkforcePoolUserProject("123456789")
+		}),
+	)
+
+	DescribeTable("rejects invalid configurations",
+		func(build func(*credentialconfig.Builder) *credentialconfig.Builder) {
+			_, err := build(builder).Build()
+			Expect(err).To(MatchError(credentialconfig.ErrInvalidConfig))
+		},
+		Entry("empty audience", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return credentialconfig.NewBuilder(" ", tokenFile)
+		}),
+		Entry("empty token file", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return credentialconfig.NewBuilder(audience, "")
+		}),
+		Entry("service account with quotes", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithServiceAccountImpersonation(`service-account@test", "type": "other`)
+		}),
+		Entry("plain http token url", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithTokenURL("http://sts.googleapis.com/v1/token")
+		}),
+		Entry("token lifetime without impersonation", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithTokenLifetime(time.Hour)
+		}),
+		Entry("token lifetime too short", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithServiceAccountImpersonation(gcpServiceAccount).WithTokenLifetime(time.Minute)
+		}),
+		Entry("token lifetime too long", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithServiceAccountImpersonation(gcpServiceAccount).WithTokenLifetime(13 * time.Hour)
+		}),
+		Entry("token lifetime with fractional seconds", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithServiceAccountImpersonation(gcpServiceAccount).WithTokenLifetime(time.Hour + time.Millisecond)
+		}),
+		Entry("invalid quota project", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithQuotaProject("Not_A_Project")
+		}),
+		Entry("invalid universe domain", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithUniverseDomain("not a domain")
+		}),
+		Entry("workforce pool user project without a workforce pool", func(b *credentialconfig.Builder) *credentialconfig.Builder {
+			return b.WithWorkforcePoolUserProject("123456789")
+		}),
+	)
+
+	DescribeTable("fails to parse invalid configurations",
+		func(data string) {
+			_, err := credentialconfig.Parse([]byte(data))
+			Expect(err).To(MatchError(credentialconfig.ErrInvalidConfig))
+		},
+		Entry("invalid json", `{"type": `),
+		Entry("wrong type", `{"type": "service_account", "audience": "a", "subject_token_type": "b", "token_url": "https://sts.googleapis.com/v1/token", "credential_source": {"file": "c"}}`),
+		Entry("unexpected impersonation url", `{"type": "external_account", "audience": "a", "subject_token_type": "b", "token_url": "https://sts.googleapis.com/v1/token", "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/other", "credential_source": {"file": "c"}}`),
+	)
+})
@@ -33,3 +33,96 @@ Selector labels
 app.kubernetes.io/name: {{ include "name" . | quote }}
 app.kubernetes.io/instance: {{ .Release.Name | quote }}
 {{- end -}}
+
+{{/*
+Webhook settings shared by the pod and the namespace opt-in webhooks
+*/}}
+{{- define "webhook.common" -}}
+rules:
+- apiGroups: [""]
+  apiVersions: ["v1"]
+  operations: ["CREATE"]
+  resources: ["pods"]
+  scope: "Namespaced"
+- apiGroups: [""]
+  apiVersions: ["v1"]
+  operations: ["UPDATE"]
+  resources: ["pods/ephemeralcontainers"]
+  scope: "Namespaced"
+clientConfig:
+  service:
+    namespace: {{ include "resource.default.namespace" . }}
+    name: {{ include "resource.default.name" . }}
+  caBundle: Cg==
+admissionReviewVersions: ["v1beta1"]
+# The injection is idempotent, so the webhook can be reinvoked to inject
+# the credentials into containers added by other webhooks.
+reinvocationPolicy: IfNeeded
+sideEffects: None
+timeoutSeconds: 10
+{{- end -}}
+
+{{/*
+Restricts the webhooks to the watched namespaces
+*/}}
+{{- define "webhook.watchedNamespaces" -}}
+{{- if .Values.watchNamespaces -}}
+- key: "kubernetes.io/metadata.name"
+  operator: In
+  values:
+  {{- range .Values.watchNamespaces }}
+  - {{ . | quote }}
+  {{- end }}
+{{- end }}
+{{- end -}}
+
+{{/*
+Rules on the ServiceAccounts, bindings and Secrets of the managed namespaces.
+The webhook only reads them.
+*/}}
+{{- define "rbac.namespacedRules" -}}
+- apiGroups:
+    - ""
+  resources:
+    - serviceaccounts
+  verbs:
+    - get
+    - list
+    - watch
+    {{- if not .Values.webhookOnly }}
+    - create
+    - update
+    - patch
+    {{- end }}
+{{- if not .Values.webhookOnly }}
+- apiGroups:
+    - workloadidentity.giantswarm.io
+  resources:
+    - workloadidentitybindings
+  verbs:
+    - get
+    - list
+    - watch
+- apiGroups:
+    - workloadidentity.giantswarm.io
+  resources:
+    - workloadidentitybindings/status
+  verbs:
+    - get
+    - update
+    - patch
+{{- end }}
+- apiGroups:
+    - ""
+  resources:
+    - secrets
+  verbs:
+    - list
+    - get
+    - watch
+    {{- if not .Values.webhookOnly }}
+    - create
+    - update
+    - delete
+    {{- end }}
+{{- end -}}
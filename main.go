@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -35,11 +36,14 @@ import (
 	capg "sigs.k8s.io/cluster-api-provider-gcp/api/v1beta1"
 	kubeadm "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	"github.com/giantswarm/workload-identity-operator-gcp/api/v1alpha1"
 	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
 	//+kubebuilder:scaffold:imports
 )
@@ -54,6 +58,7 @@ func init() {
 
 	utilruntime.Must(capg.AddToScheme(scheme))
 	utilruntime.Must(kubeadm.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -62,12 +67,57 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var webhookPort int
+	var membershipChangeQPS float64
+	var maxConcurrentReconciles int
+	var reconcileQPS float64
+	var reconcileBurst int
+	var secretNameFallback bool
+	var projectNumber string
+	var endpoints controllers.Endpoints
+	var provider controllers.WorkloadIdentityProvider
+	var enableGCPClusterController bool
+	var enableMultiCluster bool
+	var watchNamespaces string
+	var conflictPolicy string
+	var webhookOnly bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.IntVar(&webhookPort, "webhook-port", 9443, "The port for the webhook")
+	flag.Float64Var(&membershipChangeQPS, "membership-change-qps", controllers.DefaultMembershipChangeQPS,
+		"The rate at which ServiceAccounts are reconciled after the membership has changed.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The number of ServiceAccounts reconciled concurrently.")
+	flag.Float64Var(&reconcileQPS, "reconcile-qps", controllers.DefaultReconcileQPS,
+		"The maximum rate at which ServiceAccounts are reconciled.")
+	flag.IntVar(&reconcileBurst, "reconcile-burst", controllers.DefaultReconcileBurst,
+		"The number of ServiceAccounts reconciled in a burst above --reconcile-qps.")
+	flag.BoolVar(&secretNameFallback, "secret-name-fallback", false,
+		"Use a hashed credentials Secret name when the default name is taken by a Secret the operator does not manage.")
+	flag.StringVar(&projectNumber, "project-number", "",
+		"The number of the project hosting the workload identity pool. Enables publishing the IAM principals of ServiceAccounts.")
+	flag.StringVar(&endpoints.UniverseDomain, "universe-domain", "",
+		"The universe domain of the generated credentials. Defaults to googleapis.com.")
+	flag.StringVar(&endpoints.TokenURL, "token-url", "",
+		"The URL of the Security Token Service. Defaults to the STS endpoint of the universe domain.")
+	flag.StringVar(&endpoints.IAMCredentialsEndpoint, "iam-credentials-endpoint", "",
+		"The endpoint of the IAM credentials API. Defaults to the IAM credentials endpoint of the universe domain.")
+	flag.StringVar(&provider.PoolID, "workload-identity-pool", "",
+		"The ID of the workload identity pool. Enables standalone mode, without fleet-membership-operator-gcp, together with --workload-identity-provider and --project-number.")
+	flag.StringVar(&provider.ProviderID, "workload-identity-provider", "",
+		"The ID of the workload identity pool provider used in standalone mode.")
+	flag.BoolVar(&enableGCPClusterController, "enable-gcp-cluster-controller", false,
+		"Enable the controller pushing the fleet membership of annotated GCPClusters into their workload clusters. Only useful on management clusters.")
+	flag.BoolVar(&enableMultiCluster, "enable-multi-cluster", false,
+		"Reconcile the ServiceAccounts of every Cluster API workload cluster, using their kubeconfig Secrets. Only useful on management clusters.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma separated list of namespaces the operator is restricted to. Defaults to all namespaces.")
+	flag.StringVar(&conflictPolicy, "conflict-policy", string(webhook.DefaultConflictPolicy),
+		"How the webhook handles containers that set GOOGLE_APPLICATION_CREDENTIALS or use the credentials mount path themselves: skip, override or deny.")
+	flag.BoolVar(&webhookOnly, "webhook-only", false,
+		"Only run the webhook, without reconciling the ServiceAccounts. Used in workload clusters whose ServiceAccounts are reconciled from the management cluster in multi-cluster mode.")
 
 	opts := zap.Options{
 		Development: true,
@@ -78,7 +128,23 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	exitfIfError(endpoints.Validate(), "Invalid endpoints")
+	exitfIfError(webhook.ConflictPolicy(conflictPolicy).Validate(), "Invalid conflict policy")
+
+	if webhookOnly && (enableMultiCluster || enableGCPClusterController) {
+		exitfIfError(errors.New("--webhook-only can't be combined with --enable-multi-cluster or --enable-gcp-cluster-controller"), "Invalid flags")
+	}
+
+	provider.ProjectNumber = projectNumber
+	if provider.Enabled() {
+		exitfIfError(provider.Validate(), "Invalid workload identity provider")
+	}
+
+	restConfig := ctrl.GetConfigOrDie()
+
+	namespaces := controllers.ParseWatchedNamespaces(watchNamespaces)
+
+	managerOptions := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Host:                   "0.0.0.0",
@@ -87,13 +153,71 @@ func main() {
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "workload-identity-operator-gcp.giantswarm.io",
 		CertDir:                "/etc/webhook/certs",
-	})
+		NewCache:               controllers.NewCacheFunc(namespaces, controllers.ManagedSecretSelector),
+	}
+	if !namespaces.All() {
+		setupLog.Info("restricting the operator to namespaces", "namespaces", namespaces)
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, managerOptions)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	wireServiceAccountReconciler(mgr)
+	var membershipStore *controllers.MembershipStore
+	if provider.Enabled() {
+		setupLog.Info("running in standalone mode", "audience", provider.Audience())
+		membershipStore = controllers.NewStandaloneMembershipStore(provider, ctrl.Log.WithName("membership-store"))
+	} else {
+		membershipCluster, err := controllers.NewMembershipCluster(restConfig, scheme)
+		exitfIfError(err, "Failed to create membership cache")
+		if err := mgr.Add(membershipCluster); err != nil {
+			setupLog.Error(err, "unable to set up membership cache")
+			os.Exit(1)
+		}
+
+		membershipStore = controllers.NewMembershipStore(
+			membershipCluster.GetAPIReader(),
+			membershipCluster.GetCache(),
+			ctrl.Log.WithName("membership-store"),
+		)
+	}
+	if err := mgr.Add(membershipStore); err != nil {
+		setupLog.Error(err, "unable to set up membership store")
+		os.Exit(1)
+	}
+	metrics.Registry.MustRegister(controllers.NewMembershipCollector(controllers.LocalClusterName, membershipStore))
+
+	if webhookOnly {
+		setupLog.Info("running the webhook only, the service accounts are not reconciled")
+	} else {
+		serviceAccountReconciler := wireServiceAccountReconciler(mgr, controllers.ServiceAccountReconciler{
+			Membership:              membershipStore,
+			MembershipChangeQPS:     membershipChangeQPS,
+			MaxConcurrentReconciles: maxConcurrentReconciles,
+			ReconcileQPS:            reconcileQPS,
+			ReconcileBurst:          reconcileBurst,
+			SecretNameFallback:      secretNameFallback,
+			ProjectNumber:           projectNumber,
+			Endpoints:               endpoints,
+			Namespaces:              namespaces,
+		})
+		if enableMultiCluster {
+			wireWorkloadClusterReconciler(mgr, *serviceAccountReconciler)
+		}
+		if enableGCPClusterController {
+			wireGCPClusterReconciler(mgr)
+		}
+
+		err = mgr.Add(&controllers.SecretLabelMigration{
+			Client:     mgr.GetClient(),
+			APIReader:  mgr.GetAPIReader(),
+			Logger:     ctrl.Log.WithName("secret-label-migration"),
+			Namespaces: namespaces,
+		})
+		exitfIfError(err, "Failed to set up secret label migration")
+	}
 
 	//+kubebuilder:scaffold:builder
 
@@ -102,8 +226,24 @@ func main() {
 		exitfIfError(err, "Failed to create admission decoder")
 	}
 
+	// The webhook-only mode is not granted access to the bindings, which may
+	// not be installed. The pods of bound ServiceAccounts are still injected
+	// once the ServiceAccounts are reported ready.
+	var bindings client.Reader
+	if !webhookOnly {
+		bindings = mgr.GetCache()
+	}
+
 	mgr.GetWebhookServer().Register("/", &admission.Webhook{
-		Handler: webhook.NewCredentialsInjector(mgr.GetClient(), decoder),
+		Handler: webhook.NewCredentialsInjector(
+			mgr.GetClient(),
+			decoder,
+			membershipStore,
+			mgr.GetEventRecorderFor("workload-identity-operator-gcp-webhook"),
+			namespaces,
+			webhook.ConflictPolicy(conflictPolicy),
+			bindings,
+		),
 	})
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -123,17 +263,52 @@ func main() {
 	}
 }
 
-func wireServiceAccountReconciler(mgr manager.Manager) {
-	reconciler := &controllers.ServiceAccountReconciler{
-		Client: mgr.GetClient(),
-		Logger: ctrl.Log.WithName("service-account-reconciler"),
-		Scheme: mgr.GetScheme(),
-	}
+// wireServiceAccountReconciler sets up a ServiceAccountReconciler with the
+// given configuration against the cluster of the manager.
+func wireServiceAccountReconciler(mgr manager.Manager, config controllers.ServiceAccountReconciler) *controllers.ServiceAccountReconciler {
+	reconciler := &config
+	reconciler.Client = mgr.GetClient()
+	reconciler.APIReader = mgr.GetAPIReader()
+	reconciler.Logger = ctrl.Log.WithName("service-account-reconciler")
+	reconciler.Scheme = mgr.GetScheme()
+	reconciler.Recorder = mgr.GetEventRecorderFor("workload-identity-operator-gcp")
 
 	if err := reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ServiceAccount")
 		os.Exit(1)
 	}
+
+	return reconciler
+}
+
+func wireWorkloadClusterReconciler(mgr manager.Manager, template controllers.ServiceAccountReconciler) {
+	reconciler := &controllers.WorkloadClusterReconciler{
+		Client:   mgr.GetClient(),
+		Logger:   ctrl.Log.WithName("workload-cluster-reconciler"),
+		Scheme:   mgr.GetScheme(),
+		Manager:  mgr,
+		Template: template,
+	}
+
+	if err := reconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "WorkloadCluster")
+		os.Exit(1)
+	}
+}
+
+func wireGCPClusterReconciler(mgr manager.Manager) {
+	reconciler := &controllers.GCPClusterReconciler{
+		Client:    mgr.GetClient(),
+		APIReader: mgr.GetAPIReader(),
+		Logger:    ctrl.Log.WithName("gcp-cluster-reconciler"),
+		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("workload-identity-operator-gcp"),
+	}
+
+	if err := reconciler.SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "GCPCluster")
+		os.Exit(1)
+	}
 }
 
 func exitfIfError(err error, message string) {
@@ -28,6 +28,10 @@ func GetEnvOrSkip(env string) string {
 }
 
 func EnsureMembershipSecretExists(k8sClient client.Client, workloadIdentityPool, identityProvider string) {
+	EnsureNamedMembershipSecretExists(k8sClient, controllers.DefaultMembershipName, workloadIdentityPool, identityProvider)
+}
+
+func EnsureNamedMembershipSecretExists(k8sClient client.Client, name, workloadIdentityPool, identityProvider string) {
 	membership := types.MembershipData{
 		WorkloadIdentityPool: workloadIdentityPool,
 		IdentityProvider:     identityProvider,
@@ -37,7 +41,7 @@ func EnsureMembershipSecretExists(k8sClient client.Client, workloadIdentityPool,
 
 	membershipSecret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      controllers.MembershipSecretName,
+			Name:      controllers.MembershipSecretNameFor(name),
 			Namespace: controllers.DefaultMembershipSecretNamespace,
 		},
 		StringData: map[string]string{
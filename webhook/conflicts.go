@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+)
+
+// ConflictPolicy decides how the webhook handles containers whose own env
+// vars or volume mounts conflict with the injected credentials, e.g.
+// containers deliberately using a key file.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicySkip leaves the conflicting containers untouched.
+	ConflictPolicySkip ConflictPolicy = "skip"
+	// ConflictPolicyOverride replaces the conflicting entries with the
+	// injected credentials.
+	ConflictPolicyOverride ConflictPolicy = "override"
+	// ConflictPolicyDeny denies the Pod.
+	ConflictPolicyDeny ConflictPolicy = "deny"
+
+	DefaultConflictPolicy = ConflictPolicySkip
+)
+
+// Validate returns an error if the policy is unknown.
+func (p ConflictPolicy) Validate() error {
+	switch p {
+	case ConflictPolicySkip, ConflictPolicyOverride, ConflictPolicyDeny:
+		return nil
+	default:
+		return fmt.Errorf("unknown conflict policy %q, must be one of %q, %q or %q",
+			p, ConflictPolicySkip, ConflictPolicyOverride, ConflictPolicyDeny)
+	}
+}
+
+// injectContainer injects the credentials env var and the mount of the given
+// credentials volume into the container. Entries that have already been injected, e.g. when the webhook
+// is reinvoked, are left as is. Conflicting entries are resolved with the
+// policy: the returned warning describes how, and an error wrapping
+// ErrConflict is returned when the policy denies the Pod.
+func injectContainer(container *corev1.Container, volumeName string, policy ConflictPolicy) (string, error) {
+	conflicts := containerConflicts(container, volumeName)
+	description := strings.Join(conflicts, " and ")
+
+	warning := ""
+	if len(conflicts) > 0 {
+		switch policy {
+		case ConflictPolicyOverride:
+			overrideConflicts(container, volumeName)
+			warning = fmt.Sprintf("container %q %s, overridden with the workload identity credentials", container.Name, description)
+		case ConflictPolicyDeny:
+			return "", fmt.Errorf("%w: container %q %s", ErrConflict, container.Name, description)
+		default:
+			return fmt.Sprintf("credentials not injected into container %q, which %s", container.Name, description), nil
+		}
+	}
+
+	injectEnvVar(container)
+	injectVolumeMount(container, volumeName)
+
+	return warning, nil
+}
+
+// containerConflicts describes the env vars and volume mounts of the
+// container that conflict with the injected credentials.
+func containerConflicts(container *corev1.Container, volumeName string) []string {
+	conflicts := []string{}
+
+	for _, env := range container.Env {
+		if isConflictingEnvVar(env) {
+			conflicts = append(conflicts, fmt.Sprintf("already sets %s", EnvKeyGoogleApplicationCredentials))
+		}
+	}
+
+	for _, mount := range container.VolumeMounts {
+		if !isConflictingVolumeMount(mount, volumeName) {
+			continue
+		}
+
+		if mount.Name == volumeName {
+			conflicts = append(conflicts, fmt.Sprintf("mounts volume %q at %q", mount.Name, mount.MountPath))
+		} else {
+			conflicts = append(conflicts, fmt.Sprintf("already mounts volume %q at %q", mount.Name, mount.MountPath))
+		}
+	}
+
+	return conflicts
+}
+
+// overrideConflicts replaces the conflicting env vars and the volume mounted
+// at the credentials path with the injected ones. The credentials volume
+// mounted at another path is left as is, the credentials are then mounted
+// twice.
+func overrideConflicts(container *corev1.Container, volumeName string) {
+	for i := range container.Env {
+		if isConflictingEnvVar(container.Env[i]) {
+			container.Env[i] = credentialsEnvVar()
+		}
+	}
+
+	for i := range container.VolumeMounts {
+		mount := container.VolumeMounts[i]
+		if isConflictingVolumeMount(mount, volumeName) && mount.MountPath == controllers.VolumeMountWorkloadIdentityPath {
+			container.VolumeMounts[i] = credentialsVolumeMount(volumeName)
+		}
+	}
+}
+
+func isConflictingEnvVar(env corev1.EnvVar) bool {
+	return env.Name == EnvKeyGoogleApplicationCredentials &&
+		(env.Value != credentialsPath() || env.ValueFrom != nil)
+}
+
+// isConflictingVolumeMount reports whether the mount uses the credentials
+// path for another volume, or the credentials volume at another path.
+func isConflictingVolumeMount(mount corev1.VolumeMount, volumeName string) bool {
+	isCredentialsVolume := mount.Name == volumeName
+	isCredentialsPath := mount.MountPath == controllers.VolumeMountWorkloadIdentityPath
+
+	return isCredentialsVolume != isCredentialsPath
+}
@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationInjectContainers restricts the injection to the Pod
+	// containers in the given comma separated list.
+	AnnotationInjectContainers = "giantswarm.io/gcp-inject-containers"
+	// AnnotationExcludeContainers excludes the Pod containers in the given
+	// comma separated list from the injection, e.g. service mesh proxies or
+	// log shippers.
+	AnnotationExcludeContainers = "giantswarm.io/gcp-exclude-containers"
+)
+
+// containerSelector selects the containers of a Pod the credentials are
+// injected into, from its annotations. All the containers are selected by
+// default.
+type containerSelector struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func newContainerSelector(annotations map[string]string) containerSelector {
+	selector := containerSelector{
+		exclude: parseContainerNames(annotations[AnnotationExcludeContainers]),
+	}
+
+	if _, ok := annotations[AnnotationInjectContainers]; ok {
+		selector.include = parseContainerNames(annotations[AnnotationInjectContainers])
+	}
+
+	return selector
+}
+
+// Selects reports whether the credentials are injected into the container.
+func (s containerSelector) Selects(container *corev1.Container) bool {
+	if s.include != nil && !s.include[container.Name] {
+		return false
+	}
+
+	return !s.exclude[container.Name]
+}
+
+// SelectsAny reports whether the credentials are injected into any container
+// of the Pod.
+func (s containerSelector) SelectsAny(pod *corev1.Pod) bool {
+	for _, container := range podContainers(pod) {
+		if s.Selects(container) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Warnings describes the container names of the annotations that are not
+// containers of the Pod, most likely typos.
+func (s containerSelector) Warnings(pod *corev1.Pod) []string {
+	containers := map[string]bool{}
+	for _, container := range podContainers(pod) {
+		containers[container.Name] = true
+	}
+
+	warnings := []string{}
+	warnings = append(warnings, unknownContainers(AnnotationInjectContainers, s.include, containers)...)
+	warnings = append(warnings, unknownContainers(AnnotationExcludeContainers, s.exclude, containers)...)
+
+	return warnings
+}
+
+func unknownContainers(annotation string, names, containers map[string]bool) []string {
+	warnings := []string{}
+	for _, name := range sortedKeys(names) {
+		if !containers[name] {
+			warnings = append(warnings, fmt.Sprintf("%q annotation lists unknown container %q", annotation, name))
+		}
+	}
+
+	return warnings
+}
+
+func parseContainerNames(value string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -3,13 +3,20 @@ package webhook
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/giantswarm/to"
 	"github.com/go-logr/logr"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -25,19 +32,44 @@ const (
 	VolumeWorkloadIdentityName        = "workload-identity-credentials"
 	VolumeWorkloadIdentityDefaultMode = 420
 
+	SubResourceEphemeralContainers = "ephemeralcontainers"
+
 	TokenExpirationSeconds               = 7200
 	GoogleApplicationCredentialsJSONPath = "google-application-credentials.json"
+
+	EventReasonCredentialsInjected = "CredentialsInjected"
+	EventReasonInjectionDenied     = "CredentialsInjectionDenied"
+	EventReasonInjectionFailed     = "CredentialsInjectionFailed"
 )
 
 type CredentialsInjector struct {
-	client  client.Client
-	decoder *admission.Decoder
+	client     client.Client
+	decoder    *admission.Decoder
+	membership *controllers.MembershipStore
+	recorder   record.EventRecorder
+	namespaces controllers.WatchedNamespaces
+	policy     ConflictPolicy
+	bindings   client.Reader
 }
 
-func NewCredentialsInjector(client client.Client, decoder *admission.Decoder) *CredentialsInjector {
+// NewCredentialsInjector returns a CredentialsInjector. An empty policy
+// means DefaultConflictPolicy. The WorkloadIdentityBindings are read with
+// the bindings reader, so that Namespaces opted in for injection include the
+// Pods of bound ServiceAccounts. They are not read when it is nil, e.g. when
+// their CRD is not installed.
+func NewCredentialsInjector(client client.Client, decoder *admission.Decoder, membership *controllers.MembershipStore, recorder record.EventRecorder, namespaces controllers.WatchedNamespaces, policy ConflictPolicy, bindings client.Reader) *CredentialsInjector {
+	if policy == "" {
+		policy = DefaultConflictPolicy
+	}
+
 	return &CredentialsInjector{
-		client:  client,
-		decoder: decoder,
+		client:     client,
+		decoder:    decoder,
+		membership: membership,
+		recorder:   recorder,
+		namespaces: namespaces,
+		policy:     policy,
+		bindings:   bindings,
 	}
 }
 
@@ -47,44 +79,399 @@ func (w *CredentialsInjector) Handle(ctx context.Context, req admission.Request)
 	logger.Info("Handling admission request")
 	defer logger.Info("Done")
 
-	if req.Operation != admissionv1.Create {
+	admissionsTotal.WithLabelValues(string(req.Operation)).Inc()
+
+	// Ephemeral containers are added to running pods by updating the
+	// ephemeralcontainers subresource.
+	ephemeralContainersUpdate := req.Operation == admissionv1.Update && req.SubResource == SubResourceEphemeralContainers
+
+	if req.Operation != admissionv1.Create && !ephemeralContainersUpdate {
 		message := "pod already created"
 		logger.Info(message)
 		return admission.Allowed(message)
 	}
 
+	// The ServiceAccounts and Secrets of namespaces that are not managed are
+	// not cached, so their pods are left untouched instead of failing.
+	if !w.namespaces.Contains(req.Namespace) {
+		message := "namespace not managed"
+		logger.Info(message)
+		return admission.Allowed(message)
+	}
+
+	if ephemeralContainersUpdate {
+		return w.handleEphemeralContainers(ctx, req)
+	}
+
 	pod := &corev1.Pod{}
 	err := w.decoder.Decode(req, pod)
 	if err != nil {
 		logger.Error(err, "no Pod in admission request")
-		return admission.Errored(http.StatusBadRequest, err)
+		return errored(ReasonInvalidPod, http.StatusBadRequest, err)
+	}
+
+	namespace, err := w.getNamespace(ctx, req.Namespace)
+	if err != nil {
+		logger.Error(err, "failed to get namespace")
+		return errored(ReasonNamespaceError, http.StatusInternalServerError, err)
+	}
+
+	var serviceAccount *corev1.ServiceAccount
+	bound := false
+	if pod.Spec.ServiceAccountName != "" {
+		serviceAccount, err = w.getServiceAccount(ctx, req.Namespace, pod.Spec.ServiceAccountName)
+		if err != nil {
+			logger.Error(err, "failed to get service account")
+			w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionFailed,
+				fmt.Sprintf("Cannot inject credentials, failed to get ServiceAccount %q: %s", pod.Spec.ServiceAccountName, err))
+			return errored(ReasonServiceAccountError, http.StatusInternalServerError, err)
+		}
+
+		bound, err = w.isBound(ctx, serviceAccount)
+		if err != nil {
+			logger.Error(err, "failed to list workload identity bindings")
+			w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionFailed,
+				fmt.Sprintf("Cannot inject credentials, failed to list the bindings of ServiceAccount %q: %s", pod.Spec.ServiceAccountName, err))
+			return errored(ReasonServiceAccountError, http.StatusInternalServerError, err)
+		}
+	}
+
+	inject, reason := ShouldInject(pod, namespace, serviceAccount, bound)
+	if !inject {
+		logger.Info("Skipping pod", "reason", reason)
+		return admission.Allowed(reason)
+	}
+
+	identities, err := parseContainerIdentities(pod.Annotations)
+	if err != nil {
+		message := err.Error()
+		logger.Info(message)
+		w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionDenied, message)
+		return denied(ReasonInvalidAnnotation, message)
 	}
 
-	if pod.Spec.ServiceAccountName == "" {
+	selector := newContainerSelector(pod.Annotations)
+	warnings := selector.Warnings(pod)
+	warnings = append(warnings, identities.Warnings(pod)...)
+
+	if !selector.SelectsAny(pod) {
+		message := "no container selected"
+		logger.Info(message)
+		return admission.Allowed(message).WithWarnings(warnings...)
+	}
+
+	if serviceAccount == nil {
 		message := "Pod has no ServiceAccount"
 		logger.Info(message)
-		return admission.Denied(message)
+		w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionDenied, message)
+		return denied(ReasonNoServiceAccount, message)
+	}
+
+	secretName := controllers.CredentialsSecretName(serviceAccount)
+
+	// The membership is resolved the same way as in the reconciler, so that
+	// the audience of the projected token matches the credentials.
+	start := time.Now()
+	federation, err := w.getFederation(ctx, req.Namespace, serviceAccount)
+	membershipLookupDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		logger.Error(err, "failed to get membership")
+		w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionFailed,
+			fmt.Sprintf("Cannot inject credentials, the fleet membership is not available: %s", err))
+		return errored(ReasonMembershipError, http.StatusInternalServerError, err)
+	}
+
+	err = w.checkIdentities(ctx, serviceAccount, secretName, identities)
+	if errors.Is(err, ErrIdentityNotAllowed) {
+		message := fmt.Sprintf("Cannot inject the credentials of the containers impersonating their own GCP service account: %s", err)
+		logger.Info(message)
+		w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionDenied, message)
+		return denied(ReasonIdentityNotAllowed, message)
+	}
+	if errors.Is(err, ErrCredentialsNotFound) {
+		// The Pod is created again by its controller, so it is denied
+		// until the operator has generated the credentials.
+		message := fmt.Sprintf("Cannot inject the credentials of the containers impersonating their own GCP service account: %s, it is generated by the operator for ServiceAccount %q", err, pod.Spec.ServiceAccountName)
+		logger.Info(message)
+		w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionDenied, message)
+		return denied(ReasonCredentialsNotFound, message)
+	}
+	if err != nil {
+		logger.Error(err, "failed to get container credentials")
+		w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionFailed,
+			fmt.Sprintf("Cannot inject credentials, failed to get the credentials of the containers: %s", err))
+		return errored(ReasonCredentialsError, http.StatusInternalServerError, err)
+	}
+
+	mutatedPod := pod.DeepCopy()
+	conflicts := []string{}
+	mountedVolumes := map[string]bool{}
+
+	for _, container := range podContainers(mutatedPod) {
+		if !selector.Selects(container) {
+			continue
+		}
+
+		volumeName := identities.VolumeName(container.Name)
+		warning, err := injectContainer(container, volumeName, w.policy)
+		if err != nil {
+			conflicts = append(conflicts, err.Error())
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		if mountsCredentials(container, volumeName) {
+			mountedVolumes[volumeName] = true
+		}
+	}
+
+	// Only the volumes mounted by a container are injected. A conflicting
+	// volume can't be resolved per container, so the Pod is denied whatever
+	// the policy.
+	if mountedVolumes[VolumeWorkloadIdentityName] {
+		err = injectVolume(mutatedPod, credentialsVolume(federation.TokenAudience, secretName))
+		if err != nil {
+			conflicts = append(conflicts, err.Error())
+		}
+	}
+
+	for _, serviceAccount := range identities.ServiceAccounts() {
+		if !mountedVolumes[identityVolumeName(serviceAccount)] {
+			continue
+		}
+
+		err = injectVolume(mutatedPod, identityVolume(federation.TokenAudience, secretName, serviceAccount))
+		if err != nil {
+			conflicts = append(conflicts, err.Error())
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return w.denyConflicts(ctx, req, pod, conflicts)
+	}
+
+	for _, warning := range warnings {
+		logger.Info(warning)
+	}
+
+	// The webhook may be reinvoked after other webhooks mutated the Pod.
+	if equality.Semantic.DeepEqual(pod, mutatedPod) {
+		message := "credentials already injected"
+		logger.Info(message)
+		return admission.Allowed(message).WithWarnings(warnings...)
+	}
+
+	message := fmt.Sprintf("Injected credentials from secret %q for ServiceAccount %q", secretName, pod.Spec.ServiceAccountName)
+	if len(identities) > 0 {
+		message = fmt.Sprintf("%s, impersonating %q in containers %q", message, identities.ServiceAccounts(), sortedKeys(identities.containers()))
+	}
+	w.recordEvent(req, pod, corev1.EventTypeNormal, EventReasonCredentialsInjected, message)
+
+	return getPatchedResponse(pod, mutatedPod).WithWarnings(warnings...)
+}
+
+// handleEphemeralContainers injects the credentials into the ephemeral
+// containers added to a running Pod. The volumes of a running Pod can't be
+// changed, so the credentials are only injected when their volume was
+// injected at creation. The existing ephemeral containers can't be changed
+// either.
+func (w *CredentialsInjector) handleEphemeralContainers(ctx context.Context, req admission.Request) admission.Response {
+	logger := w.getLogger(ctx)
+
+	pod := &corev1.Pod{}
+	err := w.decoder.Decode(req, pod)
+	if err != nil {
+		logger.Error(err, "no Pod in admission request")
+		return errored(ReasonInvalidPod, http.StatusBadRequest, err)
 	}
 
-	secretName := fmt.Sprintf("%s-%s", pod.Spec.ServiceAccountName, "google-application-credentials")
-	membership, err := controllers.GetMembershipFromSecret(ctx, w.client, logger)
+	oldPod := &corev1.Pod{}
+	err = w.decoder.DecodeRaw(req.OldObject, oldPod)
 	if err != nil {
-		logger.Error(err, "failed to get membership from secret")
-		return admission.Errored(http.StatusInternalServerError, err)
+		logger.Error(err, "no previous Pod in admission request")
+		return errored(ReasonInvalidPod, http.StatusBadRequest, err)
+	}
+
+	identities, err := parseContainerIdentities(pod.Annotations)
+	if err != nil {
+		message := err.Error()
+		logger.Info(message)
+		return denied(ReasonInvalidAnnotation, message)
+	}
+
+	existing := map[string]bool{}
+	for _, container := range oldPod.Spec.EphemeralContainers {
+		existing[container.Name] = true
 	}
 
-	workloadIdentityPool := membership.WorkloadIdentityPool
+	selector := newContainerSelector(pod.Annotations)
 
 	mutatedPod := pod.DeepCopy()
-	injectVolume(mutatedPod, workloadIdentityPool, secretName)
+	injected := []string{}
+	conflicts := []string{}
+	warnings := []string{}
+	for i := range mutatedPod.Spec.EphemeralContainers {
+		container := &mutatedPod.Spec.EphemeralContainers[i]
+		commonContainer := (*corev1.Container)(&container.EphemeralContainerCommon)
+		if existing[container.Name] || !selector.Selects(commonContainer) {
+			continue
+		}
 
-	for i := range mutatedPod.Spec.Containers {
-		container := &mutatedPod.Spec.Containers[i]
-		injectEnvVar(container)
-		injectVolumeMount(container)
+		volumeName := identities.VolumeName(container.Name)
+		if !hasVolume(pod, volumeName) {
+			continue
+		}
+
+		original := container.DeepCopy()
+		warning, err := injectContainer(commonContainer, volumeName, w.policy)
+		if err != nil {
+			conflicts = append(conflicts, err.Error())
+			continue
+		}
+		if warning != "" {
+			warnings = append(warnings, warning)
+		}
+		if !equality.Semantic.DeepEqual(original, container) {
+			injected = append(injected, container.Name)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return w.denyConflicts(ctx, req, pod, conflicts)
+	}
+
+	for _, warning := range warnings {
+		logger.Info(warning)
 	}
 
-	return getPatchedResponse(req, mutatedPod)
+	if len(injected) == 0 {
+		message := "no ephemeral container added"
+		logger.Info(message)
+		return admission.Allowed(message).WithWarnings(warnings...)
+	}
+
+	w.recordEvent(req, pod, corev1.EventTypeNormal, EventReasonCredentialsInjected,
+		fmt.Sprintf("Injected credentials into ephemeral containers %q", injected))
+
+	return getPatchedResponse(pod, mutatedPod).WithWarnings(warnings...)
+}
+
+// denyConflicts denies a Pod whose own volumes, volume mounts or env vars
+// conflict with the injected credentials, when they can't be resolved with
+// the conflict policy. Injecting the credentials anyway would lead to
+// duplicate entries, rejected by the API server, or to containers silently
+// using other credentials.
+func (w *CredentialsInjector) denyConflicts(ctx context.Context, req admission.Request, pod *corev1.Pod, conflicts []string) admission.Response {
+	message := fmt.Sprintf("Cannot inject credentials: %s", strings.Join(conflicts, "; "))
+	w.getLogger(ctx).Info(message)
+	w.recordEvent(req, pod, corev1.EventTypeWarning, EventReasonInjectionDenied, message)
+
+	return denied(ReasonConflict, message)
+}
+
+// recordEvent records an event on the workload owning the Pod. Pods created
+// from a template don't have a name at admission time, so events can only be
+// recorded on the Pod itself when it is created directly. Dry-run requests
+// don't create the Pod, and the webhook is declared without side effects, so
+// no event is recorded for them.
+func (w *CredentialsInjector) recordEvent(req admission.Request, pod *corev1.Pod, eventType, reason, message string) {
+	if req.DryRun != nil && *req.DryRun {
+		return
+	}
+
+	namespace := req.Namespace
+	object := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Pod",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: namespace,
+			UID:       pod.UID,
+		},
+	}
+
+	owner := metav1.GetControllerOf(pod)
+	if owner != nil {
+		object.TypeMeta = metav1.TypeMeta{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+		}
+		object.ObjectMeta = metav1.ObjectMeta{
+			Name:      owner.Name,
+			Namespace: namespace,
+			UID:       owner.UID,
+		}
+	}
+
+	if object.Name == "" {
+		return
+	}
+
+	w.recorder.Event(object, eventType, reason, message)
+}
+
+// getServiceAccount returns the ServiceAccount of the Pod. The
+// ServiceAccount may not exist yet, in which case an empty ServiceAccount
+// with the given name is returned, so that the defaults are used.
+func (w *CredentialsInjector) getServiceAccount(ctx context.Context, namespace, serviceAccountName string) (*corev1.ServiceAccount, error) {
+	serviceAccount := &corev1.ServiceAccount{}
+	err := w.client.Get(ctx, client.ObjectKey{
+		Namespace: namespace,
+		Name:      serviceAccountName,
+	}, serviceAccount)
+	if k8serrors.IsNotFound(err) {
+		serviceAccount.Name = serviceAccountName
+		serviceAccount.Namespace = namespace
+		return serviceAccount, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return serviceAccount, nil
+}
+
+// isBound reports whether a WorkloadIdentityBinding names the
+// ServiceAccount. It is always false when the bindings are not read.
+func (w *CredentialsInjector) isBound(ctx context.Context, serviceAccount *corev1.ServiceAccount) (bool, error) {
+	if w.bindings == nil {
+		return false, nil
+	}
+
+	bindings, err := controllers.ListServiceAccountBindings(ctx, w.bindings, client.ObjectKeyFromObject(serviceAccount))
+	if err != nil {
+		return false, err
+	}
+
+	return len(bindings) > 0, nil
+}
+
+// getNamespace returns the Namespace with the given name, or nil if it
+// doesn't exist.
+func (w *CredentialsInjector) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	namespace := &corev1.Namespace{}
+	err := w.client.Get(ctx, client.ObjectKey{Name: name}, namespace)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return namespace, nil
+}
+
+// getFederation returns the Federation of the membership selected by the
+// ServiceAccount or its Namespace.
+func (w *CredentialsInjector) getFederation(ctx context.Context, namespace string, serviceAccount *corev1.ServiceAccount) (controllers.Federation, error) {
+	name, err := controllers.ResolveMembershipName(ctx, w.client, namespace, serviceAccount.Annotations)
+	if err != nil {
+		return controllers.Federation{}, err
+	}
+
+	return w.membership.Federation(ctx, name)
 }
 
 func (w *CredentialsInjector) getLogger(ctx context.Context) logr.Logger {
@@ -92,36 +479,168 @@ func (w *CredentialsInjector) getLogger(ctx context.Context) logr.Logger {
 	return logger.WithName("credentials-injector-webhook")
 }
 
-func getPatchedResponse(req admission.Request, mutatedPod *corev1.Pod) admission.Response {
-	marshaledPod, err := json.Marshal(mutatedPod)
+// getPatchedResponse patches the Pod of the request into the mutated Pod.
+// Decoding the Pod drops the fields the operator doesn't know about, e.g. the
+// restartPolicy of native sidecars, so the patch is computed from the decoded
+// Pod rather than from the raw object, which would remove them.
+func getPatchedResponse(pod, mutatedPod *corev1.Pod) admission.Response {
+	marshaledPod, err := json.Marshal(pod)
 	if err != nil {
-		return admission.Errored(http.StatusInternalServerError, err)
+		return errored(ReasonPatchError, http.StatusInternalServerError, err)
 	}
 
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	marshaledMutatedPod, err := json.Marshal(mutatedPod)
+	if err != nil {
+		return errored(ReasonPatchError, http.StatusInternalServerError, err)
+	}
+
+	mutationsTotal.Inc()
+	return admission.PatchResponseFromRaw(marshaledPod, marshaledMutatedPod)
 }
 
+// podContainers returns all the containers of the Pod: the init containers,
+// which include native sidecars, the containers and the ephemeral
+// containers.
+func podContainers(pod *corev1.Pod) []*corev1.Container {
+	containers := []*corev1.Container{}
+	for i := range pod.Spec.InitContainers {
+		containers = append(containers, &pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		containers = append(containers, &pod.Spec.Containers[i])
+	}
+	for i := range pod.Spec.EphemeralContainers {
+		containers = append(containers, (*corev1.Container)(&pod.Spec.EphemeralContainers[i].EphemeralContainerCommon))
+	}
+
+	return containers
+}
+
+func hasVolume(pod *corev1.Pod, volumeName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == volumeName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func denied(reason, message string) admission.Response {
+	denialsTotal.WithLabelValues(reason).Inc()
+	return admission.Denied(message)
+}
+
+func errored(reason string, code int32, err error) admission.Response {
+	errorsTotal.WithLabelValues(reason).Inc()
+	return admission.Errored(code, err)
+}
+
+// ErrConflict is returned when the Pod defines a volume, a volume mount or an
+// env var that conflicts with the injected credentials.
+var ErrConflict = errors.New("conflict")
+
 func injectEnvVar(container *corev1.Container) {
-	credentialsPath := fmt.Sprintf("%s/%s", controllers.VolumeMountWorkloadIdentityPath, GoogleApplicationCredentialsJSONPath)
+	for _, env := range container.Env {
+		if env.Name == EnvKeyGoogleApplicationCredentials {
+			return
+		}
+	}
+
+	container.Env = append(container.Env, credentialsEnvVar())
+}
+
+func injectVolumeMount(container *corev1.Container, volumeName string) {
+	for i := range container.VolumeMounts {
+		mount := &container.VolumeMounts[i]
+		if mount.Name == volumeName && mount.MountPath == controllers.VolumeMountWorkloadIdentityPath {
+			mount.ReadOnly = true
+			return
+		}
+	}
+
+	container.VolumeMounts = append(container.VolumeMounts, credentialsVolumeMount(volumeName))
+}
 
-	credentialsEnvVar := corev1.EnvVar{
+// mountsCredentials reports whether the container mounts the given
+// credentials volume at the credentials path.
+func mountsCredentials(container *corev1.Container, volumeName string) bool {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == volumeName && mount.MountPath == controllers.VolumeMountWorkloadIdentityPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+func credentialsEnvVar() corev1.EnvVar {
+	return corev1.EnvVar{
 		Name:  EnvKeyGoogleApplicationCredentials,
-		Value: credentialsPath,
+		Value: credentialsPath(),
 	}
-	container.Env = append(container.Env, credentialsEnvVar)
 }
 
-func injectVolumeMount(container *corev1.Container) {
-	credentialsMount := corev1.VolumeMount{
-		Name:      VolumeWorkloadIdentityName,
+func credentialsVolumeMount(volumeName string) corev1.VolumeMount {
+	return corev1.VolumeMount{
+		Name:      volumeName,
 		MountPath: controllers.VolumeMountWorkloadIdentityPath,
 		ReadOnly:  true,
 	}
-	container.VolumeMounts = append(container.VolumeMounts, credentialsMount)
 }
 
-func injectVolume(pod *corev1.Pod, workloadIdentityPool, secretName string) {
-	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+func credentialsPath() string {
+	return fmt.Sprintf("%s/%s", controllers.VolumeMountWorkloadIdentityPath, GoogleApplicationCredentialsJSONPath)
+}
+
+// injectVolume adds the credentials volume to the Pod. A credentials volume
+// that has already been injected is updated, as the audience or the Secret
+// may have changed since, e.g. when the volume comes from a Pod template.
+func injectVolume(pod *corev1.Pod, volume corev1.Volume) error {
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name != volume.Name {
+			continue
+		}
+
+		if !isCredentialsVolume(pod.Spec.Volumes[i]) {
+			return fmt.Errorf("%w: volume %q is already defined by the pod", ErrConflict, volume.Name)
+		}
+
+		pod.Spec.Volumes[i] = volume
+		return nil
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+	return nil
+}
+
+// isCredentialsVolume reports whether the volume has been injected by the
+// webhook.
+func isCredentialsVolume(volume corev1.Volume) bool {
+	if volume.Projected == nil {
+		return false
+	}
+
+	hasToken, hasCredentials := false, false
+	for _, source := range volume.Projected.Sources {
+		if source.ServiceAccountToken != nil && source.ServiceAccountToken.Path == controllers.ServiceAccountTokenPath {
+			hasToken = true
+		}
+
+		if source.Secret != nil {
+			for _, item := range source.Secret.Items {
+				if item.Path == GoogleApplicationCredentialsJSONPath {
+					hasCredentials = true
+				}
+			}
+		}
+	}
+
+	return hasToken && hasCredentials
+}
+
+func credentialsVolume(audience, secretName string) corev1.Volume {
+	return corev1.Volume{
 		Name: VolumeWorkloadIdentityName,
 		VolumeSource: corev1.VolumeSource{
 			Projected: &corev1.ProjectedVolumeSource{
@@ -130,7 +649,7 @@ func injectVolume(pod *corev1.Pod, workloadIdentityPool, secretName string) {
 					{
 						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
 							Path:     controllers.ServiceAccountTokenPath,
-							Audience: workloadIdentityPool,
+							Audience: audience,
 
 							// According to documentation, the service account token will be
 							// rotated automatically by the kubelet when it's close to
@@ -156,5 +675,5 @@ func injectVolume(pod *corev1.Pod, workloadIdentityPool, secretName string) {
 				},
 			},
 		},
-	})
+	}
 }
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 
+	jsonpatchapply "github.com/evanphx/json-patch"
+	"github.com/giantswarm/to"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"gomodules.xyz/jsonpatch/v2"
@@ -13,6 +15,10 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
@@ -24,6 +30,7 @@ var _ = Describe("Credentials", func() {
 	var (
 		ctx                context.Context
 		credentialsWebhook *webhook.CredentialsInjector
+		recorder           *record.FakeRecorder
 
 		pod      corev1.Pod
 		request  admission.Request
@@ -39,7 +46,10 @@ var _ = Describe("Credentials", func() {
 
 		decoder, err := admission.NewDecoder(runtime.NewScheme())
 		Expect(err).NotTo(HaveOccurred())
-		credentialsWebhook = webhook.NewCredentialsInjector(k8sClient, decoder)
+		membershipStore := controllers.NewMembershipStore(k8sClient, nil, ctrl.Log.WithName("membership-store"))
+		recorder = record.NewFakeRecorder(100)
+		recorder.IncludeObject = true
+		credentialsWebhook = webhook.NewCredentialsInjector(k8sClient, decoder, membershipStore, recorder, nil, "", nil)
 		tests.EnsureMembershipSecretExists(k8sClient, workloadIdentityPool, identityProvider)
 
 		pod = corev1.Pod{
@@ -84,6 +94,13 @@ var _ = Describe("Credentials", func() {
 		response = credentialsWebhook.Handle(ctx, request)
 	})
 
+	useConflictPolicy := func(policy webhook.ConflictPolicy) {
+		decoder, err := admission.NewDecoder(runtime.NewScheme())
+		Expect(err).NotTo(HaveOccurred())
+		membershipStore := controllers.NewMembershipStore(k8sClient, nil, ctrl.Log.WithName("membership-store"))
+		credentialsWebhook = webhook.NewCredentialsInjector(k8sClient, decoder, membershipStore, recorder, nil, policy, nil)
+	}
+
 	It("injects the env var in all containers of the pod", func() {
 		Expect(response.AdmissionResponse.Allowed).To(BeTrue())
 		Expect(response.Patches).To(ContainElements(
@@ -174,6 +191,722 @@ var _ = Describe("Credentials", func() {
 		))
 	})
 
+	It("records the injection on the pod", func() {
+		Expect(recorder.Events).To(Receive(SatisfyAll(
+			HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeNormal, webhook.EventReasonCredentialsInjected)),
+			ContainSubstring("kind=Pod"),
+		)))
+	})
+
+	When("the pod is owned by a workload", func() {
+		BeforeEach(func() {
+			pod.Name = ""
+			pod.GenerateName = "the-replicaset-"
+			pod.OwnerReferences = []metav1.OwnerReference{
+				{
+					APIVersion: "apps/v1",
+					Kind:       "ReplicaSet",
+					Name:       "the-replicaset",
+					UID:        "the-replicaset-uid",
+					Controller: to.BoolP(true),
+				},
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("records the injection on the owning workload", func() {
+			Expect(recorder.Events).To(Receive(SatisfyAll(
+				HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeNormal, webhook.EventReasonCredentialsInjected)),
+				ContainSubstring("kind=ReplicaSet"),
+			)))
+		})
+	})
+
+	When("the request is a dry run", func() {
+		BeforeEach(func() {
+			request.DryRun = to.BoolP(true)
+		})
+
+		It("injects the credentials", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patches).NotTo(BeEmpty())
+		})
+
+		It("does not record the injection", func() {
+			Expect(recorder.Events).NotTo(Receive())
+		})
+
+		When("the request is denied", func() {
+			BeforeEach(func() {
+				pod.Spec.ServiceAccountName = ""
+				request.Object = encodeObject(pod)
+			})
+
+			It("does not record the denial", func() {
+				Expect(response.Allowed).To(BeFalse())
+				Expect(recorder.Events).NotTo(Receive())
+			})
+		})
+	})
+
+	When("the namespace selects a named membership", func() {
+		BeforeEach(func() {
+			tests.EnsureNamedMembershipSecretExists(k8sClient, "other-fleet", "other.svc.id.goog", "https://other.default.local")
+
+			namespaceObj := &corev1.Namespace{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+			namespaceObj.Annotations = map[string]string{
+				controllers.AnnotationGCPMembership: "other-fleet",
+			}
+			Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			namespaceObj := &corev1.Namespace{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+			namespaceObj.Annotations = nil
+			Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+		})
+
+		It("uses the named workload identity pool as the token audience", func() {
+			Expect(response.Allowed).To(BeTrue())
+
+			patch := findPatch(response.Patches, "/spec/volumes")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ContainElement(HaveKeyWithValue("projected", HaveKeyWithValue("sources", ContainElement(
+				HaveKeyWithValue("serviceAccountToken", HaveKeyWithValue("audience", "other.svc.id.goog")),
+			)))))
+		})
+	})
+
+	When("the webhook runs in standalone mode", func() {
+		BeforeEach(func() {
+			decoder, err := admission.NewDecoder(runtime.NewScheme())
+			Expect(err).NotTo(HaveOccurred())
+			membershipStore := controllers.NewStandaloneMembershipStore(controllers.WorkloadIdentityProvider{
+				ProjectNumber: "123456789",
+				PoolID:        "the-pool",
+				ProviderID:    "the-provider",
+			}, ctrl.Log.WithName("membership-store"))
+			credentialsWebhook = webhook.NewCredentialsInjector(k8sClient, decoder, membershipStore, recorder, nil, "", nil)
+		})
+
+		It("uses the provider as the token audience", func() {
+			Expect(response.Allowed).To(BeTrue())
+
+			patch := findPatch(response.Patches, "/spec/volumes")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ContainElement(HaveKeyWithValue("projected", HaveKeyWithValue("sources", ContainElement(
+				HaveKeyWithValue("serviceAccountToken", HaveKeyWithValue("audience",
+					"//iam.googleapis.com/projects/123456789/locations/global/workloadIdentityPools/the-pool/providers/the-provider")),
+			)))))
+		})
+	})
+
+	When("the namespace is not managed by the webhook", func() {
+		BeforeEach(func() {
+			decoder, err := admission.NewDecoder(runtime.NewScheme())
+			Expect(err).NotTo(HaveOccurred())
+			membershipStore := controllers.NewMembershipStore(k8sClient, nil, ctrl.Log.WithName("membership-store"))
+			credentialsWebhook = webhook.NewCredentialsInjector(k8sClient, decoder, membershipStore, recorder, controllers.WatchedNamespaces{"other"}, "", nil)
+		})
+
+		It("allows the request without injecting credentials", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patches).To(BeEmpty())
+		})
+	})
+
+	When("the pod opts out with the label value", func() {
+		BeforeEach(func() {
+			pod.Labels[webhook.LabelWorkloadIdentity] = "false"
+			request.Object = encodeObject(pod)
+		})
+
+		It("allows the request without injecting credentials", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patches).To(BeEmpty())
+		})
+	})
+
+	When("the pod opts out with the annotation", func() {
+		BeforeEach(func() {
+			pod.Annotations = map[string]string{
+				webhook.AnnotationInject: "false",
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("allows the request without injecting credentials", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patches).To(BeEmpty())
+		})
+	})
+
+	When("the namespace opts in and the pod is not labelled", func() {
+		BeforeEach(func() {
+			namespaceObj := &corev1.Namespace{}
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: namespace}, namespaceObj)).To(Succeed())
+			namespaceObj.Labels[webhook.LabelWorkloadIdentity] = "true"
+			Expect(k8sClient.Update(ctx, namespaceObj)).To(Succeed())
+
+			delete(pod.Labels, webhook.LabelWorkloadIdentity)
+			request.Object = encodeObject(pod)
+		})
+
+		It("allows the request without injecting credentials", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patches).To(BeEmpty())
+		})
+
+		When("the service account is annotated", func() {
+			BeforeEach(func() {
+				serviceAccount := &corev1.ServiceAccount{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "the-service-account",
+						Namespace: namespace,
+						Annotations: map[string]string{
+							controllers.AnnotationGCPServiceAccount: "service-account@email",
+						},
+					},
+				}
+				Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+			})
+
+			It("injects the credentials", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(findPatch(response.Patches, "/spec/volumes")).NotTo(BeNil())
+			})
+		})
+	})
+
+	When("the service account uses a fallback credentials secret name", func() {
+		BeforeEach(func() {
+			serviceAccount := &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "the-service-account",
+					Namespace: namespace,
+					Annotations: map[string]string{
+						controllers.AnnotationCredentialsSecretName: "the-fallback-secret",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+		})
+
+		It("projects the fallback secret", func() {
+			Expect(response.Allowed).To(BeTrue())
+
+			patch := findPatch(response.Patches, "/spec/volumes")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ContainElement(HaveKeyWithValue("projected", HaveKeyWithValue("sources", ContainElement(
+				HaveKeyWithValue("secret", HaveKeyWithValue("name", "the-fallback-secret")),
+			)))))
+		})
+	})
+
+	When("the webhook is reinvoked", func() {
+		JustBeforeEach(func() {
+			Expect(response.Allowed).To(BeTrue())
+
+			request.Object = runtime.RawExtension{Raw: applyPatches(request.Object.Raw, response.Patches)}
+			response = credentialsWebhook.Handle(ctx, request)
+		})
+
+		It("does not inject the credentials again", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patches).To(BeEmpty())
+		})
+	})
+
+	When("the pod already has an outdated credentials volume", func() {
+		BeforeEach(func() {
+			pod.Spec.Volumes = []corev1.Volume{
+				{
+					Name: webhook.VolumeWorkloadIdentityName,
+					VolumeSource: corev1.VolumeSource{
+						Projected: &corev1.ProjectedVolumeSource{
+							Sources: []corev1.VolumeProjection{
+								{
+									ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+										Path:     controllers.ServiceAccountTokenPath,
+										Audience: "outdated.svc.id.goog",
+									},
+								},
+								{
+									Secret: &corev1.SecretProjection{
+										LocalObjectReference: corev1.LocalObjectReference{Name: "the-outdated-secret"},
+										Items: []corev1.KeyToPath{
+											{
+												Key:  controllers.SecretKeyGoogleApplicationCredentials,
+												Path: webhook.GoogleApplicationCredentialsJSONPath,
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("updates the volume instead of adding another one", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patches).To(ContainElements(
+				jsonpatch.Operation{
+					Operation: "replace",
+					Path:      "/spec/volumes/0/projected/sources/0/serviceAccountToken/audience",
+					Value:     workloadIdentityPool,
+				},
+				jsonpatch.Operation{
+					Operation: "replace",
+					Path:      "/spec/volumes/0/projected/sources/1/secret/name",
+					Value:     "the-service-account-google-application-credentials",
+				},
+			))
+			Expect(findPatch(response.Patches, "/spec/volumes/1")).To(BeNil())
+		})
+	})
+
+	When("the pod defines another volume with the credentials volume name", func() {
+		BeforeEach(func() {
+			pod.Spec.Volumes = []corev1.Volume{
+				{
+					Name:         webhook.VolumeWorkloadIdentityName,
+					VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+				},
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("denies the request", func() {
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.Result.Message).To(ContainSubstring(webhook.VolumeWorkloadIdentityName))
+		})
+	})
+
+	When("a container sets its own credentials", func() {
+		BeforeEach(func() {
+			pod.Spec.Containers[1].Env = append(pod.Spec.Containers[1].Env, corev1.EnvVar{
+				Name:  webhook.EnvKeyGoogleApplicationCredentials,
+				Value: "/etc/gcp/key.json",
+			})
+			request.Object = encodeObject(pod)
+		})
+
+		It("skips the container", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(findPatch(response.Patches, "/spec/containers/0/volumeMounts")).NotTo(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/1/volumeMounts")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/1/env/3")).To(BeNil())
+		})
+
+		It("warns about the skipped container", func() {
+			Expect(response.Warnings).To(ConsistOf(
+				`credentials not injected into container "second-container", which already sets GOOGLE_APPLICATION_CREDENTIALS`,
+			))
+		})
+
+		When("the conflict policy is override", func() {
+			BeforeEach(func() {
+				useConflictPolicy(webhook.ConflictPolicyOverride)
+			})
+
+			It("overrides the env var", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Patches).To(ContainElements(
+					jsonpatch.Operation{
+						Operation: "replace",
+						Path:      "/spec/containers/1/env/2/value",
+						Value:     "/var/run/secrets/workload-identity/google-application-credentials.json",
+					},
+				))
+				Expect(findPatch(response.Patches, "/spec/containers/1/volumeMounts")).NotTo(BeNil())
+				Expect(findPatch(response.Patches, "/spec/containers/1/env/3")).To(BeNil())
+			})
+
+			It("warns about the overridden env var", func() {
+				Expect(response.Warnings).To(ConsistOf(
+					`container "second-container" already sets GOOGLE_APPLICATION_CREDENTIALS, overridden with the workload identity credentials`,
+				))
+			})
+		})
+
+		When("the conflict policy is deny", func() {
+			BeforeEach(func() {
+				useConflictPolicy(webhook.ConflictPolicyDeny)
+			})
+
+			It("denies the request", func() {
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(`container "second-container" already sets GOOGLE_APPLICATION_CREDENTIALS`))
+			})
+		})
+	})
+
+	When("a container mounts another volume at the credentials path", func() {
+		BeforeEach(func() {
+			pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+				{Name: "the-volume", MountPath: controllers.VolumeMountWorkloadIdentityPath},
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("skips the container", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(findPatch(response.Patches, "/spec/containers/0/volumeMounts/1")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/0/env/2")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/1/volumeMounts")).NotTo(BeNil())
+		})
+
+		It("warns about the skipped container", func() {
+			Expect(response.Warnings).To(ConsistOf(
+				`credentials not injected into container "first-container", which already mounts volume "the-volume" at "/var/run/secrets/workload-identity"`,
+			))
+		})
+
+		When("the conflict policy is override", func() {
+			BeforeEach(func() {
+				useConflictPolicy(webhook.ConflictPolicyOverride)
+			})
+
+			It("replaces the volume mount", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Patches).To(ContainElements(
+					jsonpatch.Operation{
+						Operation: "replace",
+						Path:      "/spec/containers/0/volumeMounts/0/name",
+						Value:     webhook.VolumeWorkloadIdentityName,
+					},
+				))
+				Expect(findPatch(response.Patches, "/spec/containers/0/volumeMounts/1")).To(BeNil())
+			})
+
+			It("warns about the overridden volume mount", func() {
+				Expect(response.Warnings).To(HaveLen(1))
+				Expect(response.Warnings[0]).To(ContainSubstring("overridden with the workload identity credentials"))
+			})
+		})
+
+		When("the conflict policy is deny", func() {
+			BeforeEach(func() {
+				useConflictPolicy(webhook.ConflictPolicyDeny)
+			})
+
+			It("denies the request", func() {
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(`container "first-container" already mounts volume "the-volume"`))
+			})
+		})
+	})
+
+	When("the pod lists the containers to inject the credentials into", func() {
+		BeforeEach(func() {
+			pod.Annotations = map[string]string{
+				webhook.AnnotationInjectContainers: "second-container",
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("only injects the credentials into the listed containers", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(findPatch(response.Patches, "/spec/containers/0/env/2")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/0/volumeMounts")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/1/env/2")).NotTo(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/1/volumeMounts")).NotTo(BeNil())
+			Expect(findPatch(response.Patches, "/spec/volumes")).NotTo(BeNil())
+		})
+
+		When("a listed container does not exist", func() {
+			BeforeEach(func() {
+				pod.Annotations[webhook.AnnotationInjectContainers] = "second-container, typo-container"
+				request.Object = encodeObject(pod)
+			})
+
+			It("warns about the unknown container", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Warnings).To(ConsistOf(
+					`"giantswarm.io/gcp-inject-containers" annotation lists unknown container "typo-container"`,
+				))
+			})
+		})
+	})
+
+	When("the pod excludes containers from the injection", func() {
+		BeforeEach(func() {
+			pod.Annotations = map[string]string{
+				webhook.AnnotationExcludeContainers: "first-container",
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("does not inject the credentials into the excluded containers", func() {
+			Expect(response.Allowed).To(BeTrue())
+			Expect(findPatch(response.Patches, "/spec/containers/0/env/2")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/0/volumeMounts")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/containers/1/env/2")).NotTo(BeNil())
+		})
+
+		When("all the containers are excluded", func() {
+			BeforeEach(func() {
+				pod.Annotations[webhook.AnnotationExcludeContainers] = "first-container,second-container"
+				request.Object = encodeObject(pod)
+			})
+
+			It("allows the request without injecting credentials", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Patches).To(BeEmpty())
+			})
+		})
+	})
+
+	When("a container impersonates its own GCP service account", func() {
+		const uploaderServiceAccount = "uploader@testing-1234.iam.gserviceaccount.com"
+
+		var identitySecretName string
+
+		BeforeEach(func() {
+			serviceAccount := &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "the-service-account",
+					Namespace: namespace,
+					Annotations: map[string]string{
+						controllers.AnnotationGCPServiceAccount:            "app@testing-1234.iam.gserviceaccount.com",
+						controllers.AnnotationGCPAdditionalServiceAccounts: uploaderServiceAccount,
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+
+			identitySecretName = controllers.IdentitySecretName("the-service-account-google-application-credentials", uploaderServiceAccount)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      identitySecretName,
+					Namespace: namespace,
+				},
+			}
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+
+			pod.Annotations = map[string]string{
+				webhook.AnnotationContainerServiceAccounts: "second-container=" + uploaderServiceAccount,
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("mounts a separate credentials volume into the container", func() {
+			Expect(response.Allowed).To(BeTrue())
+
+			patch := findPatch(response.Patches, "/spec/volumes")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ConsistOf(
+				HaveKeyWithValue("name", webhook.VolumeWorkloadIdentityName),
+				HaveKeyWithValue("name", HavePrefix(webhook.VolumeWorkloadIdentityName+"-")),
+			))
+
+			patch = findPatch(response.Patches, "/spec/containers/1/volumeMounts")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ConsistOf(
+				HaveKeyWithValue("name", HavePrefix(webhook.VolumeWorkloadIdentityName+"-")),
+			))
+
+			patch = findPatch(response.Patches, "/spec/containers/0/volumeMounts")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ConsistOf(
+				HaveKeyWithValue("name", webhook.VolumeWorkloadIdentityName),
+			))
+		})
+
+		It("projects the credentials secret of the GCP service account of the container", func() {
+			patch := findPatch(response.Patches, "/spec/volumes")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ContainElement(And(
+				HaveKeyWithValue("name", HavePrefix(webhook.VolumeWorkloadIdentityName+"-")),
+				HaveKeyWithValue("projected", HaveKeyWithValue("sources", ContainElement(
+					HaveKeyWithValue("secret", HaveKeyWithValue("name", identitySecretName)),
+				))),
+			)))
+		})
+
+		It("does not store the credentials in the pod", func() {
+			Expect(findPatch(response.Patches, "/metadata/annotations")).To(BeNil())
+		})
+
+		When("all the containers impersonate their own GCP service account", func() {
+			BeforeEach(func() {
+				pod.Annotations[webhook.AnnotationContainerServiceAccounts] = "first-container=" + uploaderServiceAccount + ",second-container=" + uploaderServiceAccount
+				request.Object = encodeObject(pod)
+			})
+
+			It("only injects the volume of their identity", func() {
+				Expect(response.Allowed).To(BeTrue())
+
+				patch := findPatch(response.Patches, "/spec/volumes")
+				Expect(patch).NotTo(BeNil())
+				Expect(patch.Value).To(ConsistOf(
+					HaveKeyWithValue("name", HavePrefix(webhook.VolumeWorkloadIdentityName+"-")),
+				))
+			})
+		})
+
+		When("the GCP service account is not allowed by the service account", func() {
+			BeforeEach(func() {
+				pod.Annotations[webhook.AnnotationContainerServiceAccounts] = "second-container=admin@testing-1234.iam.gserviceaccount.com"
+				request.Object = encodeObject(pod)
+			})
+
+			It("denies the request", func() {
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Code).To(Equal(int32(http.StatusForbidden)))
+				Expect(response.Result.Message).To(ContainSubstring(controllers.AnnotationGCPAdditionalServiceAccounts))
+			})
+
+			It("records the denial", func() {
+				Expect(recorder.Events).To(Receive(HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeWarning, webhook.EventReasonInjectionDenied))))
+			})
+		})
+
+		When("the annotation is invalid", func() {
+			BeforeEach(func() {
+				pod.Annotations[webhook.AnnotationContainerServiceAccounts] = "second-container"
+				request.Object = encodeObject(pod)
+			})
+
+			It("denies the request", func() {
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Message).To(ContainSubstring(webhook.AnnotationContainerServiceAccounts))
+			})
+		})
+	})
+
+	When("a container impersonates its own GCP service account before the credentials secret is created", func() {
+		BeforeEach(func() {
+			serviceAccount := &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "the-service-account",
+					Namespace: namespace,
+					Annotations: map[string]string{
+						controllers.AnnotationGCPServiceAccount:            "app@testing-1234.iam.gserviceaccount.com",
+						controllers.AnnotationGCPAdditionalServiceAccounts: "uploader@testing-1234.iam.gserviceaccount.com",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, serviceAccount)).To(Succeed())
+
+			pod.Annotations = map[string]string{
+				webhook.AnnotationContainerServiceAccounts: "second-container=uploader@testing-1234.iam.gserviceaccount.com",
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("denies the request", func() {
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.Result.Code).To(Equal(int32(http.StatusForbidden)))
+			Expect(response.Result.Message).To(ContainSubstring("does not exist yet"))
+		})
+
+		It("records the denial", func() {
+			Expect(recorder.Events).To(Receive(HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeWarning, webhook.EventReasonInjectionDenied))))
+		})
+	})
+
+	When("the pod has init containers", func() {
+		BeforeEach(func() {
+			pod.Spec.InitContainers = []corev1.Container{
+				{Name: "the-init-container"},
+			}
+			request.Object = encodeObject(pod)
+		})
+
+		It("injects the credentials in the init containers", func() {
+			Expect(response.Allowed).To(BeTrue())
+
+			patch := findPatch(response.Patches, "/spec/initContainers/0/env")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ContainElement(HaveKeyWithValue("name", webhook.EnvKeyGoogleApplicationCredentials)))
+			Expect(findPatch(response.Patches, "/spec/initContainers/0/volumeMounts")).NotTo(BeNil())
+		})
+
+		When("the init container is a native sidecar", func() {
+			BeforeEach(func() {
+				// The restartPolicy of containers is not known to the
+				// version of the API the operator is built with.
+				object := map[string]interface{}{}
+				Expect(json.Unmarshal(request.Object.Raw, &object)).To(Succeed())
+				spec := object["spec"].(map[string]interface{})
+				initContainer := spec["initContainers"].([]interface{})[0].(map[string]interface{})
+				initContainer["restartPolicy"] = "Always"
+				request.Object = encodeObject(object)
+			})
+
+			It("keeps the restart policy of the sidecar", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(findPatch(response.Patches, "/spec/initContainers/0/env")).NotTo(BeNil())
+				Expect(response.Patches).NotTo(ContainElement(HaveField("Operation", "remove")))
+			})
+		})
+	})
+
+	When("ephemeral containers are added to the pod", func() {
+		BeforeEach(func() {
+			pod.Spec.Volumes = []corev1.Volume{
+				{Name: webhook.VolumeWorkloadIdentityName},
+			}
+			pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "the-existing-debugger"}},
+			}
+			request.OldObject = encodeObject(pod)
+
+			pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "the-new-debugger"},
+			})
+			request.Object = encodeObject(pod)
+			request.Operation = admissionv1.Update
+			request.SubResource = webhook.SubResourceEphemeralContainers
+		})
+
+		It("injects the credentials in the new ephemeral containers", func() {
+			Expect(response.Allowed).To(BeTrue())
+
+			patch := findPatch(response.Patches, "/spec/ephemeralContainers/1/env")
+			Expect(patch).NotTo(BeNil())
+			Expect(patch.Value).To(ContainElement(HaveKeyWithValue("name", webhook.EnvKeyGoogleApplicationCredentials)))
+			Expect(findPatch(response.Patches, "/spec/ephemeralContainers/1/volumeMounts")).NotTo(BeNil())
+		})
+
+		It("does not change the existing ephemeral containers", func() {
+			Expect(findPatch(response.Patches, "/spec/ephemeralContainers/0/env")).To(BeNil())
+			Expect(findPatch(response.Patches, "/spec/ephemeralContainers/0/volumeMounts")).To(BeNil())
+		})
+
+		When("the new ephemeral container is excluded", func() {
+			BeforeEach(func() {
+				pod.Annotations = map[string]string{
+					webhook.AnnotationExcludeContainers: "the-new-debugger",
+				}
+				request.Object = encodeObject(pod)
+			})
+
+			It("does not inject the credentials", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Patches).To(BeEmpty())
+			})
+		})
+
+		When("the credentials were not injected into the pod", func() {
+			BeforeEach(func() {
+				pod.Spec.Volumes = nil
+				request.Object = encodeObject(pod)
+			})
+
+			It("allows the request", func() {
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Patches).To(BeEmpty())
+			})
+		})
+	})
+
 	Context("the passed pod has already been created", func() {
 		When("operation is Update", func() {
 			BeforeEach(func() {
@@ -210,9 +943,13 @@ var _ = Describe("Credentials", func() {
 	})
 
 	When("the pod doesn't have a service account", func() {
+		var denials float64
+
 		BeforeEach(func() {
 			pod.Spec.ServiceAccountName = ""
 			request.Object = encodeObject(pod)
+
+			denials = getCounterValue("workload_identity_webhook_denials_total", webhook.ReasonNoServiceAccount)
 		})
 
 		It("denies the request", func() {
@@ -220,6 +957,14 @@ var _ = Describe("Credentials", func() {
 			Expect(response.Result).NotTo(BeNil())
 			Expect(response.Result.Code).To(Equal(int32(http.StatusForbidden)))
 		})
+
+		It("records the denial", func() {
+			Expect(recorder.Events).To(Receive(HavePrefix(fmt.Sprintf("%s %s", corev1.EventTypeWarning, webhook.EventReasonInjectionDenied))))
+		})
+
+		It("counts the denial", func() {
+			Expect(getCounterValue("workload_identity_webhook_denials_total", webhook.ReasonNoServiceAccount)).To(Equal(denials + 1))
+		})
 	})
 
 	When("the context has been canceled", func() {
@@ -234,6 +979,23 @@ var _ = Describe("Credentials", func() {
 		})
 	})
 
+	When("the context has been canceled before the membership is loaded", func() {
+		It("returns a 500 Internal Server Error", func() {
+			canceledCtx, cancel := context.WithCancel(ctx)
+			cancel()
+
+			decoder, err := admission.NewDecoder(runtime.NewScheme())
+			Expect(err).NotTo(HaveOccurred())
+			membershipStore := controllers.NewMembershipStore(k8sClient, nil, ctrl.Log.WithName("membership-store"))
+			unloadedWebhook := webhook.NewCredentialsInjector(k8sClient, decoder, membershipStore, recorder, nil, "", nil)
+
+			canceledResult := unloadedWebhook.Handle(canceledCtx, request)
+			Expect(canceledResult.AdmissionResponse.Allowed).To(BeFalse())
+			Expect(canceledResult.Result).NotTo(BeNil())
+			Expect(canceledResult.Result.Code).To(Equal(int32(http.StatusInternalServerError)))
+		})
+	})
+
 	When("the request is empty", func() {
 		BeforeEach(func() {
 			request.Object = runtime.RawExtension{}
@@ -247,9 +1009,55 @@ var _ = Describe("Credentials", func() {
 	})
 })
 
+func findPatch(patches []jsonpatch.Operation, path string) *jsonpatch.Operation {
+	for i := range patches {
+		if patches[i].Path == path {
+			return &patches[i]
+		}
+	}
+
+	return nil
+}
+
+func applyPatches(raw []byte, patches []jsonpatch.Operation) []byte {
+	encodedPatches, err := json.Marshal(patches)
+	Expect(err).NotTo(HaveOccurred())
+
+	patch, err := jsonpatchapply.DecodePatch(encodedPatches)
+	Expect(err).NotTo(HaveOccurred())
+
+	patched, err := patch.Apply(raw)
+	Expect(err).NotTo(HaveOccurred())
+
+	return patched
+}
+
 func encodeObject(obj interface{}) runtime.RawExtension {
 	encodedObj, err := json.Marshal(obj)
 	Expect(err).NotTo(HaveOccurred())
 
 	return runtime.RawExtension{Raw: encodedObj}
 }
+
+// getCounterValue returns the value of the counter with the given name and
+// reason label from the controller-runtime metrics registry.
+func getCounterValue(name, reason string) float64 {
+	families, err := metrics.Registry.Gather()
+	Expect(err).NotTo(HaveOccurred())
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" && label.GetValue() == reason {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
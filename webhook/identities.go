@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+	"github.com/giantswarm/workload-identity-operator-gcp/credentialconfig"
+)
+
+const (
+	// AnnotationContainerServiceAccounts maps containers of the Pod to the
+	// GCP service accounts they impersonate instead of the one of the Pod
+	// ServiceAccount, as a comma separated list of container=email pairs.
+	// The service accounts must be listed in the
+	// controllers.AnnotationGCPAdditionalServiceAccounts annotation of the
+	// ServiceAccount.
+	AnnotationContainerServiceAccounts = "giantswarm.io/gcp-container-service-accounts"
+)
+
+var (
+	// ErrCredentialsNotFound is returned when the credentials Secret of a
+	// container identity has not been created by the operator yet.
+	ErrCredentialsNotFound = errors.New("credentials not found")
+
+	// ErrIdentityNotAllowed is returned when a container impersonates a GCP
+	// service account the Pod ServiceAccount doesn't allow.
+	ErrIdentityNotAllowed = errors.New("identity not allowed")
+)
+
+// containerIdentities maps container names to the GCP service accounts they
+// impersonate.
+type containerIdentities map[string]string
+
+// parseContainerIdentities parses the AnnotationContainerServiceAccounts
+// annotation of a Pod.
+func parseContainerIdentities(annotations map[string]string) (containerIdentities, error) {
+	identities := containerIdentities{}
+
+	value, ok := annotations[AnnotationContainerServiceAccounts]
+	if !ok {
+		return identities, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		container, serviceAccount, found := strings.Cut(entry, "=")
+		container = strings.TrimSpace(container)
+		serviceAccount = strings.TrimSpace(serviceAccount)
+		if !found || container == "" || serviceAccount == "" {
+			return nil, fmt.Errorf("invalid %q annotation: %q is not a container=service-account pair", AnnotationContainerServiceAccounts, entry)
+		}
+
+		if _, ok := identities[container]; ok {
+			return nil, fmt.Errorf("invalid %q annotation: container %q is listed twice", AnnotationContainerServiceAccounts, container)
+		}
+
+		err := credentialconfig.ValidateServiceAccount(serviceAccount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q annotation: %w", AnnotationContainerServiceAccounts, err)
+		}
+
+		identities[container] = serviceAccount
+	}
+
+	return identities, nil
+}
+
+// VolumeName returns the name of the credentials volume mounted into the
+// container.
+func (i containerIdentities) VolumeName(container string) string {
+	serviceAccount, ok := i[container]
+	if !ok {
+		return VolumeWorkloadIdentityName
+	}
+
+	return identityVolumeName(serviceAccount)
+}
+
+// ServiceAccounts returns the sorted GCP service accounts of the containers.
+func (i containerIdentities) ServiceAccounts() []string {
+	serviceAccounts := map[string]bool{}
+	for _, serviceAccount := range i {
+		serviceAccounts[serviceAccount] = true
+	}
+
+	return sortedKeys(serviceAccounts)
+}
+
+// Warnings describes the container names of the annotation that are not
+// containers of the Pod.
+func (i containerIdentities) Warnings(pod *corev1.Pod) []string {
+	containers := map[string]bool{}
+	for _, container := range podContainers(pod) {
+		containers[container.Name] = true
+	}
+
+	return unknownContainers(AnnotationContainerServiceAccounts, i.containers(), containers)
+}
+
+func (i containerIdentities) containers() map[string]bool {
+	containers := map[string]bool{}
+	for container := range i {
+		containers[container] = true
+	}
+
+	return containers
+}
+
+// checkIdentities checks that the GCP service accounts of the containers are
+// listed in the AnnotationGCPAdditionalServiceAccounts annotation of the Pod
+// ServiceAccount, and that the operator has generated their credentials
+// Secrets.
+func (w *CredentialsInjector) checkIdentities(ctx context.Context, serviceAccount *corev1.ServiceAccount, secretName string, identities containerIdentities) error {
+	if len(identities) == 0 {
+		return nil
+	}
+
+	allowed, err := controllers.AdditionalServiceAccounts(serviceAccount.Annotations)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrIdentityNotAllowed, err)
+	}
+
+	allowedServiceAccounts := map[string]bool{}
+	for _, identity := range allowed {
+		allowedServiceAccounts[identity] = true
+	}
+
+	for _, identity := range identities.ServiceAccounts() {
+		if !allowedServiceAccounts[identity] {
+			return fmt.Errorf("%w: %q is not listed in the %q annotation of ServiceAccount %q",
+				ErrIdentityNotAllowed, identity, controllers.AnnotationGCPAdditionalServiceAccounts, serviceAccount.Name)
+		}
+
+		name := controllers.IdentitySecretName(secretName, identity)
+		err := w.client.Get(ctx, client.ObjectKey{Namespace: serviceAccount.Namespace, Name: name}, &corev1.Secret{})
+		if k8serrors.IsNotFound(err) {
+			return fmt.Errorf("%w: secret %q of %q does not exist yet", ErrCredentialsNotFound, name, identity)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get credentials secret %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func identityVolumeName(serviceAccount string) string {
+	hash := sha256.Sum256([]byte(serviceAccount))
+	return fmt.Sprintf("%s-%s", VolumeWorkloadIdentityName, hex.EncodeToString(hash[:])[:10])
+}
+
+// identityVolume projects the token of the Pod ServiceAccount together with
+// the credentials Secret impersonating the given GCP service account.
+func identityVolume(audience, secretName, serviceAccount string) corev1.Volume {
+	volume := credentialsVolume(audience, controllers.IdentitySecretName(secretName, serviceAccount))
+	volume.Name = identityVolumeName(serviceAccount)
+
+	return volume
+}
@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	metricsNamespace = "workload_identity"
+	metricsSubsystem = "webhook"
+
+	ReasonNoServiceAccount    = "no_service_account"
+	ReasonInvalidPod          = "invalid_pod"
+	ReasonMembershipError     = "membership_error"
+	ReasonServiceAccountError = "service_account_error"
+	ReasonNamespaceError      = "namespace_error"
+	ReasonPatchError          = "patch_error"
+	ReasonConflict            = "conflict"
+	ReasonInvalidAnnotation   = "invalid_annotation"
+	ReasonCredentialsError    = "credentials_error"
+	ReasonCredentialsNotFound = "credentials_not_found"
+	ReasonIdentityNotAllowed  = "identity_not_allowed"
+)
+
+var (
+	admissionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "admissions_total",
+		Help:      "Number of admission requests handled by the credentials injector, by operation.",
+	}, []string{"operation"})
+
+	mutationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "mutations_total",
+		Help:      "Number of Pods the credentials have been injected into.",
+	})
+
+	denialsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "denials_total",
+		Help:      "Number of admission requests denied by the credentials injector, by reason.",
+	}, []string{"reason"})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "errors_total",
+		Help:      "Number of admission requests the credentials injector failed to handle, by reason.",
+	}, []string{"reason"})
+
+	membershipLookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "membership_lookup_duration_seconds",
+		Help:      "Time taken to look up the membership during admission.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		admissionsTotal,
+		mutationsTotal,
+		denialsTotal,
+		errorsTotal,
+		membershipLookupDuration,
+	)
+}
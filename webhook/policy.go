@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+)
+
+const (
+	// AnnotationInject disables the injection into a Pod when set to
+	// "false", whatever the labels of the Pod and of its Namespace.
+	AnnotationInject = "giantswarm.io/gcp-inject"
+
+	// LabelValueDisabled disables the injection when set as the value of
+	// LabelWorkloadIdentity, as well as "false".
+	LabelValueDisabled = "disabled"
+)
+
+// ShouldInject decides whether the credentials are injected into the Pod,
+// and returns the reason of the decision:
+//
+//   - the AnnotationInject annotation of the Pod set to "false" opts the Pod
+//     out;
+//   - otherwise the LabelWorkloadIdentity label of the Pod opts it in, unless
+//     it is set to "false" or LabelValueDisabled;
+//   - otherwise the LabelWorkloadIdentity label of the Namespace opts in the
+//     Pods whose ServiceAccount is configured for workload identity, with the
+//     same values. The ServiceAccount is configured when it is annotated,
+//     when bound is true, i.e. a WorkloadIdentityBinding names it, or when
+//     the operator has reported its credentials as ready.
+//
+// The namespace and the ServiceAccount may be nil, e.g. when they don't
+// exist.
+func ShouldInject(pod *corev1.Pod, namespace *corev1.Namespace, serviceAccount *corev1.ServiceAccount, bound bool) (bool, string) {
+	if value, ok := pod.Annotations[AnnotationInject]; ok && isDisabled(value) {
+		return false, fmt.Sprintf("pod opted out with the %q annotation", AnnotationInject)
+	}
+
+	if value, ok := pod.Labels[LabelWorkloadIdentity]; ok {
+		if isDisabled(value) {
+			return false, fmt.Sprintf("pod opted out with the %q label", LabelWorkloadIdentity)
+		}
+
+		return true, fmt.Sprintf("pod opted in with the %q label", LabelWorkloadIdentity)
+	}
+
+	if namespace == nil {
+		return false, "pod did not opt in"
+	}
+
+	value, ok := namespace.Labels[LabelWorkloadIdentity]
+	if !ok || isDisabled(value) {
+		return false, "neither the pod nor its namespace opted in"
+	}
+
+	if serviceAccount == nil || !isConfigured(serviceAccount, bound) {
+		return false, "namespace opted in, but the service account is not configured for workload identity"
+	}
+
+	return true, fmt.Sprintf("namespace opted in with the %q label", LabelWorkloadIdentity)
+}
+
+// isConfigured reports whether the ServiceAccount is configured for
+// workload identity, either with annotations or with a binding.
+func isConfigured(serviceAccount *corev1.ServiceAccount, bound bool) bool {
+	return bound ||
+		controllers.IsWorkloadIdentityEnabled(serviceAccount.Annotations) ||
+		controllers.IsWorkloadIdentityReady(serviceAccount)
+}
+
+// isDisabled reports whether the label or annotation value disables the
+// injection. Any other value, including an empty one, enables it.
+func isDisabled(value string) bool {
+	if strings.EqualFold(strings.TrimSpace(value), LabelValueDisabled) {
+		return true
+	}
+
+	enabled, err := strconv.ParseBool(strings.TrimSpace(value))
+	return err == nil && !enabled
+}
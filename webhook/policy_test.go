@@ -0,0 +1,96 @@
+package webhook_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/giantswarm/workload-identity-operator-gcp/controllers"
+	"github.com/giantswarm/workload-identity-operator-gcp/webhook"
+)
+
+var _ = Describe("Injection Policy", func() {
+	var (
+		annotatedServiceAccount = &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "the-service-account",
+				Annotations: map[string]string{
+					controllers.AnnotationGCPServiceAccount: "service-account@email",
+				},
+			},
+		}
+		readyServiceAccount = &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "the-service-account",
+				Annotations: map[string]string{
+					controllers.AnnotationReady: "True",
+				},
+			},
+		}
+		serviceAccount = &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "the-service-account",
+			},
+		}
+
+		newPod = func(labels, annotations map[string]string) *corev1.Pod {
+			return &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "the-pod",
+					Labels:      labels,
+					Annotations: annotations,
+				},
+			}
+		}
+		newNamespace = func(labels map[string]string) *corev1.Namespace {
+			return &corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "the-namespace",
+					Labels: labels,
+				},
+			}
+		}
+	)
+
+	DescribeTable("decides whether to inject the credentials",
+		func(pod *corev1.Pod, namespace *corev1.Namespace, serviceAccount *corev1.ServiceAccount, bound, expected bool) {
+			inject, reason := webhook.ShouldInject(pod, namespace, serviceAccount, bound)
+			Expect(inject).To(Equal(expected))
+			Expect(reason).NotTo(BeEmpty())
+		},
+		Entry("pod labelled",
+			newPod(map[string]string{webhook.LabelWorkloadIdentity: "enabled"}, nil), newNamespace(nil), serviceAccount, false, true),
+		Entry("pod labelled with an empty value",
+			newPod(map[string]string{webhook.LabelWorkloadIdentity: ""}, nil), newNamespace(nil), serviceAccount, false, true),
+		Entry("pod labelled false",
+			newPod(map[string]string{webhook.LabelWorkloadIdentity: "false"}, nil), newNamespace(nil), annotatedServiceAccount, false, false),
+		Entry("pod labelled disabled",
+			newPod(map[string]string{webhook.LabelWorkloadIdentity: "disabled"}, nil), newNamespace(nil), annotatedServiceAccount, false, false),
+		Entry("pod not labelled",
+			newPod(nil, nil), newNamespace(nil), annotatedServiceAccount, false, false),
+		Entry("pod labelled and opted out",
+			newPod(map[string]string{webhook.LabelWorkloadIdentity: "true"}, map[string]string{webhook.AnnotationInject: "false"}),
+			newNamespace(nil), annotatedServiceAccount, false, false),
+		Entry("namespace labelled with an annotated service account",
+			newPod(nil, nil), newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "true"}), annotatedServiceAccount, false, true),
+		Entry("namespace labelled without an annotated service account",
+			newPod(nil, nil), newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "true"}), serviceAccount, false, false),
+		Entry("namespace labelled with a bound service account",
+			newPod(nil, nil), newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "true"}), serviceAccount, true, true),
+		Entry("namespace labelled with a ready service account",
+			newPod(nil, nil), newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "true"}), readyServiceAccount, false, true),
+		Entry("namespace labelled without a service account",
+			newPod(nil, nil), newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "true"}), nil, false, false),
+		Entry("namespace labelled disabled",
+			newPod(nil, nil), newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "disabled"}), annotatedServiceAccount, false, false),
+		Entry("namespace labelled and pod opted out",
+			newPod(nil, map[string]string{webhook.AnnotationInject: "false"}),
+			newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "true"}), annotatedServiceAccount, false, false),
+		Entry("namespace labelled and pod labelled false",
+			newPod(map[string]string{webhook.LabelWorkloadIdentity: "false"}, nil),
+			newNamespace(map[string]string{webhook.LabelWorkloadIdentity: "true"}), annotatedServiceAccount, false, false),
+		Entry("namespace missing",
+			newPod(nil, nil), nil, annotatedServiceAccount, false, false),
+	)
+})